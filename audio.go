@@ -0,0 +1,192 @@
+package bring
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Audio mimetypes advertised to the server by default. Both are raw PCM formats, with the sample
+// rate and number of channels informed as parameters of the mimetype (ex: audio/L16;rate=44100,channels=2)
+var defaultAudioMimetypes = []string{"audio/L8", "audio/L16"}
+
+// AudioFrame is a chunk of decoded audio received from the server. Samples are signed 16 bits PCM,
+// interleaved when there is more than one channel. 8 bits audio is scaled to 16 bits
+type AudioFrame struct {
+	Rate     int
+	Channels int
+	Samples  []int16
+}
+
+// OnAudioFunc is the signature for OnAudio event handlers
+type OnAudioFunc = func(frame AudioFrame)
+
+// OnAudio sets a function that will be called with the audio played by the remote session, as soon as
+// it is received. If no handler is set, all audio streams are refused. The handler is called from the
+// Client's main loop, so it should return quickly
+func (c *Client) OnAudio(f OnAudioFunc) {
+	c.onAudio = f
+}
+
+// audioFormat is the raw PCM format described by the mimetype of an audio stream
+type audioFormat struct {
+	bytesPerSample int
+	rate           int
+	channels       int
+}
+
+// parseAudioFormat parses mimetypes in the format used by the server for raw audio, like
+// audio/L16;rate=44100,channels=2. If not specified, the number of channels is 1
+func parseAudioFormat(mimetype string) (*audioFormat, error) {
+	parts := strings.SplitN(mimetype, ";", 2)
+	f := &audioFormat{channels: 1}
+	switch strings.TrimSpace(parts[0]) {
+	case "audio/L8":
+		f.bytesPerSample = 1
+	case "audio/L16":
+		f.bytesPerSample = 2
+	default:
+		return nil, fmt.Errorf("unsupported audio mimetype %s", mimetype)
+	}
+	if len(parts) > 1 {
+		for _, param := range strings.Split(parts[1], ",") {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "rate":
+				f.rate, _ = strconv.Atoi(kv[1])
+			case "channels":
+				f.channels, _ = strconv.Atoi(kv[1])
+			}
+		}
+	}
+	if f.rate <= 0 || f.channels <= 0 {
+		return nil, fmt.Errorf("invalid audio format %s", mimetype)
+	}
+	return f, nil
+}
+
+// audioDecoder decodes the blobs of an audio stream to PCM frames. Samples split between
+// blobs are kept until the rest of them is received
+type audioDecoder struct {
+	client  *Client
+	idx     int
+	format  *audioFormat
+	pending []byte
+}
+
+// receive is used as the onBlob handler of the stream
+func (d *audioDecoder) receive(_ *stream, data string) error {
+	blob, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		d.client.logger.Errorf("Invalid audio received for stream %d: %s", d.idx, err)
+		return d.client.streams.sendAck(d.idx, "Invalid data", StatusClientBadType)
+	}
+
+	d.pending = append(d.pending, blob...)
+	frameSize := d.format.bytesPerSample * d.format.channels
+	n := len(d.pending) - len(d.pending)%frameSize
+	if n > 0 {
+		d.client.onAudio(AudioFrame{
+			Rate:     d.format.rate,
+			Channels: d.format.channels,
+			Samples:  d.decode(d.pending[:n]),
+		})
+		d.pending = append(d.pending[:0], d.pending[n:]...)
+	}
+	return d.client.streams.sendAck(d.idx, "OK", StatusSuccess)
+}
+
+// decode converts the raw data to signed 16 bits samples. L16 is little-endian, and L8 is signed
+func (d *audioDecoder) decode(data []byte) []int16 {
+	samples := make([]int16, len(data)/d.format.bytesPerSample)
+	for i := range samples {
+		if d.format.bytesPerSample == 1 {
+			samples[i] = int16(int8(data[i])) << 8
+		} else {
+			samples[i] = int16(binary.LittleEndian.Uint16(data[i*2:]))
+		}
+	}
+	return samples
+}
+
+// Size of the header of WAV files with PCM audio
+const wavHeaderSize = 44
+
+var errWAVFormatChanged = errors.New("audio format changed")
+
+// WAVWriter writes audio frames to a WAV file, as 16 bits PCM. All frames must have the same rate and
+// number of channels. The file is only valid after the WAVWriter is closed
+type WAVWriter struct {
+	w        io.WriteSeeker
+	rate     int
+	channels int
+	size     int
+}
+
+// NewWAVWriter creates a WAVWriter that writes to w. The WAVWriter does not close w
+func NewWAVWriter(w io.WriteSeeker) *WAVWriter {
+	return &WAVWriter{w: w}
+}
+
+// WriteFrame appends the frame samples to the file. The format of the file is defined by the first frame
+func (w *WAVWriter) WriteFrame(frame AudioFrame) error {
+	if w.rate == 0 {
+		w.rate, w.channels = frame.Rate, frame.Channels
+		if _, err := w.w.Write(w.header()); err != nil {
+			return err
+		}
+	}
+	if frame.Rate != w.rate || frame.Channels != w.channels {
+		return errWAVFormatChanged
+	}
+	buf := make([]byte, len(frame.Samples)*2)
+	for i, sample := range frame.Samples {
+		binary.LittleEndian.PutUint16(buf[i*2:], uint16(sample))
+	}
+	n, err := w.w.Write(buf)
+	w.size += n
+	return err
+}
+
+// Close writes the final sizes to the file header
+func (w *WAVWriter) Close() error {
+	if w.rate == 0 {
+		return nil
+	}
+	if _, err := w.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(w.header()); err != nil {
+		return err
+	}
+	_, err := w.w.Seek(0, io.SeekEnd)
+	return err
+}
+
+func (w *WAVWriter) header() []byte {
+	const bitsPerSample = 16
+	blockAlign := w.channels * bitsPerSample / 8
+
+	h := make([]byte, wavHeaderSize)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], uint32(wavHeaderSize-8+w.size))
+	copy(h[8:], "WAVE")
+	copy(h[12:], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16) // Size of the fmt chunk
+	binary.LittleEndian.PutUint16(h[20:], 1)  // PCM
+	binary.LittleEndian.PutUint16(h[22:], uint16(w.channels))
+	binary.LittleEndian.PutUint32(h[24:], uint32(w.rate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(w.rate*blockAlign))
+	binary.LittleEndian.PutUint16(h[32:], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(h[34:], bitsPerSample)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], uint32(w.size))
+	return h
+}
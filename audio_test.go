@@ -0,0 +1,106 @@
+package bring
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+
+	"github.com/deluan/bring/protocol"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Audio", func() {
+	var c *Client
+	var t *mockTunnel
+	var frames []AudioFrame
+
+	BeforeEach(func() {
+		t = &mockTunnel{}
+		c = newTestClient(t)
+		frames = nil
+		c.OnAudio(func(frame AudioFrame) {
+			frames = append(frames, frame)
+		})
+	})
+
+	blob := func(data ...byte) string {
+		return base64.StdEncoding.EncodeToString(data)
+	}
+
+	It("decodes little-endian 16 bits audio", func() {
+		Expect(handlers["audio"](c, []string{"1", "audio/L16;rate=44100,channels=2"})).To(Succeed())
+		Expect(handlers["blob"](c, []string{"1", blob(0x01, 0x00, 0xff, 0xff, 0x00, 0x80, 0xff, 0x7f)})).To(Succeed())
+
+		Expect(frames).To(Equal([]AudioFrame{{Rate: 44100, Channels: 2, Samples: []int16{1, -1, -32768, 32767}}}))
+		Expect(t.sent).To(Equal([]*protocol.Instruction{protocol.NewInstruction("ack", "1", "OK", "0")}))
+	})
+
+	It("decodes signed 8 bits audio, scaling it to 16 bits", func() {
+		Expect(handlers["audio"](c, []string{"1", "audio/L8;rate=8000"})).To(Succeed())
+		Expect(handlers["blob"](c, []string{"1", blob(0x01, 0xff, 0x80)})).To(Succeed())
+
+		Expect(frames).To(Equal([]AudioFrame{{Rate: 8000, Channels: 1, Samples: []int16{256, -256, -32768}}}))
+	})
+
+	It("keeps samples split between blobs until they are complete", func() {
+		Expect(handlers["audio"](c, []string{"1", "audio/L16;rate=22050,channels=2"})).To(Succeed())
+		Expect(handlers["blob"](c, []string{"1", blob(0x01, 0x00, 0x02)})).To(Succeed())
+		Expect(frames).To(BeEmpty())
+
+		Expect(handlers["blob"](c, []string{"1", blob(0x00, 0x03, 0x00)})).To(Succeed())
+		Expect(frames).To(Equal([]AudioFrame{{Rate: 22050, Channels: 2, Samples: []int16{1, 2}}}))
+		Expect(t.sent).To(HaveLen(2))
+	})
+
+	It("refuses unsupported formats", func() {
+		Expect(handlers["audio"](c, []string{"1", "audio/ogg"})).To(Succeed())
+		Expect(t.sent).To(Equal([]*protocol.Instruction{
+			protocol.NewInstruction("ack", "1", "Unsupported audio format", "783"),
+		}))
+	})
+
+	It("refuses audio if there is no handler", func() {
+		c.OnAudio(nil)
+		Expect(handlers["audio"](c, []string{"1", "audio/L16;rate=44100"})).To(Succeed())
+		Expect(t.sent).To(Equal([]*protocol.Instruction{
+			protocol.NewInstruction("ack", "1", "Audio unsupported", "256"),
+		}))
+	})
+
+	Describe("parseAudioFormat", func() {
+		It("requires the rate", func() {
+			_, err := parseAudioFormat("audio/L16;channels=2")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("WAVWriter", func() {
+		It("writes the samples with a valid header", func() {
+			f, err := ioutil.TempFile("", "bring-*.wav")
+			Expect(err).To(BeNil())
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			w := NewWAVWriter(f)
+			Expect(w.WriteFrame(AudioFrame{Rate: 8000, Channels: 2, Samples: []int16{1, -1}})).To(Succeed())
+			Expect(w.WriteFrame(AudioFrame{Rate: 8000, Channels: 2, Samples: []int16{2, -2}})).To(Succeed())
+			Expect(w.WriteFrame(AudioFrame{Rate: 44100, Channels: 2})).To(HaveOccurred())
+			Expect(w.Close()).To(Succeed())
+
+			data, err := ioutil.ReadFile(f.Name())
+			Expect(err).To(BeNil())
+			Expect(data).To(HaveLen(wavHeaderSize + 8))
+			Expect(string(data[0:4])).To(Equal("RIFF"))
+			Expect(binary.LittleEndian.Uint32(data[4:])).To(Equal(uint32(36 + 8)))
+			Expect(string(data[8:16])).To(Equal("WAVEfmt "))
+			Expect(binary.LittleEndian.Uint16(data[22:])).To(Equal(uint16(2)))
+			Expect(binary.LittleEndian.Uint32(data[24:])).To(Equal(uint32(8000)))
+			Expect(binary.LittleEndian.Uint32(data[28:])).To(Equal(uint32(32000)))
+			Expect(string(data[36:40])).To(Equal("data"))
+			Expect(binary.LittleEndian.Uint32(data[40:])).To(Equal(uint32(8)))
+			Expect(data[44:]).To(Equal([]byte{0x01, 0x00, 0xff, 0xff, 0x02, 0x00, 0xfe, 0xff}))
+		})
+	})
+})
@@ -1,9 +1,12 @@
 package bring
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	"image"
 	"strconv"
+	"time"
 
 	"github.com/deluan/bring/protocol"
 )
@@ -11,63 +14,175 @@ import (
 // ErrInvalidKeyCode is returned by SendKey if an invalid code is passed
 var ErrInvalidKeyCode = errors.New("invalid key code")
 
+// ErrInvalidSize is returned by Resize if the width or height are not positive
+var ErrInvalidSize = errors.New("invalid display size")
+
+// Maximum time NewClient and NewClientWithOptions wait for the connection and handshake to complete
+const defaultHandshakeTimeout = 30 * time.Second
+
 // OnSyncFunc is the signature for OnSync event handlers. It will receive the current screen image and the
 // timestamp of the last update.
 type OnSyncFunc = func(image image.Image, lastUpdate int64)
 
+// OnErrorFunc is the signature for OnError event handlers. It will receive the error reported by the server
+type OnErrorFunc = func(err *ServerError)
+
+// OnStateChangeFunc is the signature for OnStateChange event handlers. It will receive the new
+// and the previous session states
+type OnStateChangeFunc = func(state, previous SessionState)
+
+// OnRequiredFunc is the signature for OnRequired event handlers. It will receive the names of the
+// parameters required by the server, and must return the values for the ones it can provide
+type OnRequiredFunc = func(parameters []string) map[string]string
+
+// OnClipboardFunc is the signature for OnClipboard event handlers. It will receive the mimetype
+// and contents of the remote clipboard
+type OnClipboardFunc = func(mimetype string, data []byte)
+
 // Client is the main struct in this library, it represents the Guacamole protocol client.
 // Automatically handles incoming and outgoing Guacamole instructions, updating its display
 // using one or more graphic primitives.
 type Client struct {
 	session *session
 	display *display
-	streams streams
+	streams *streamManager
 	logger  Logger
 	onSync  OnSyncFunc
+	onError OnErrorFunc
+
+	onRequired  OnRequiredFunc
+	onClipboard OnClipboardFunc
+	onFile      OnFileFunc
+	onAudio     OnAudioFunc
+	onPipe      OnPipeFunc
+
+	objects      objects
+	onFilesystem OnFilesystemFunc
+
+	videoDecoder VideoDecoder
 }
 
 // NewClient creates a Client and connects it to the guacd server with the provided configuration. Logger is optional
 func NewClient(addr string, remoteProtocol string, config map[string]string, logger ...Logger) (*Client, error) {
-	var log Logger
+	opts := []Option{WithAddress(addr)}
 	if len(logger) > 0 {
-		log = logger[0]
-	} else {
-		log = &DefaultLogger{}
+		opts = append(opts, WithLogger(logger[0]))
+	}
+	return NewClientWithOptions(remoteProtocol, config, opts...)
+}
+
+// NewClientWithOptions creates a Client and connects it to the server with the provided configuration.
+// The tunnel used to connect to the server must be specified with one of the WithAddress, WithTunnel
+// or WithDialer options
+func NewClientWithOptions(remoteProtocol string, config map[string]string, opts ...Option) (*Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultHandshakeTimeout)
+	defer cancel()
+	return NewClientWithContext(ctx, remoteProtocol, config, opts...)
+}
+
+// NewClientWithContext is like NewClientWithOptions, but the connection and handshake with the
+// server are bound to the context provided: if it is cancelled or its deadline expires before the
+// session is established, the connection is aborted and the context's error is returned. Once the
+// Client is returned, the context has no effect on it. See Run for controlling the session lifecycle
+func NewClientWithContext(ctx context.Context, remoteProtocol string, config map[string]string, opts ...Option) (*Client, error) {
+	o := newOptions(opts)
+	if o.dialer == nil {
+		return nil, ErrNoTunnel
 	}
 
-	s, err := newSession(addr, remoteProtocol, config, log)
+	s, err := newSession(ctx, remoteProtocol, config, o)
 	if err != nil {
 		return nil, err
 	}
 
 	c := &Client{
 		session: s,
-		display: newDisplay(log),
-		streams: newStreams(),
-		logger:  log,
+		display: newDisplay(o.logger),
+		streams: newStreamManager(s.Send, o.logger),
+		logger:  o.logger,
+
+		videoDecoder: o.videoDecoder,
 	}
 	return c, nil
 }
 
 // Start the Client's main loop. It is a blocking call, so it
-// should be called in its on goroutine
+// should be called in its on goroutine. It returns when the session ends.
+// See Run for a version that can be cancelled and reports why the session ended
 func (c *Client) Start() {
+	_ = c.Run(context.Background())
+}
+
+// Run the Client's main loop, processing all instructions received from the server. It is a blocking
+// call that only returns when the session ends or the context is done. In the latter case, the
+// Client is closed and the context's error is returned. If the session ends normally, nil is returned.
+// Otherwise, the error that caused the session to end is returned. Errors reported by the server
+// are returned as *ServerError
+func (c *Client) Run(ctx context.Context) error {
 	for {
 		select {
-		case ins := <-c.session.In:
-			h, ok := handlers[ins.Opcode]
+		case ins, ok := <-c.session.In:
 			if !ok {
-				c.logger.Errorf("Instruction not implemented: %s", ins.Opcode)
-				continue
+				<-c.session.done
+				return c.session.err
 			}
-			err := h(c, ins.Args)
-			if err != nil {
-				c.session.Terminate()
+			c.handle(ins)
+		case <-c.session.done:
+			c.drain()
+			return c.session.err
+		case <-ctx.Done():
+			c.Close()
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Client) handle(ins *protocol.Instruction) {
+	h, ok := handlers[ins.Opcode]
+	if !ok {
+		c.logger.Errorf("Instruction not implemented: %s", ins.Opcode)
+		return
+	}
+	err := h(c, ins.Args)
+	if err != nil {
+		c.session.terminate(err)
+	}
+}
+
+// drain processes the instructions received before the session ended (ex: the error that ended it),
+// so they are not lost
+func (c *Client) drain() {
+	for {
+		select {
+		case ins, ok := <-c.session.In:
+			if !ok {
+				return
 			}
+			c.handle(ins)
+		default:
+			return
 		}
 	}
 }
 
+// Done returns a channel that is closed when the session ends, either because it was closed
+// by the server, by the Client's Close method or due to an error
+func (c *Client) Done() <-chan struct{} {
+	return c.session.done
+}
+
+// Close the Client, disconnecting it from the server and releasing all its resources.
+// Any call to Run or Start will return
+func (c *Client) Close() {
+	c.session.Terminate()
+}
+
+// ConnectionID returns the ID of the connection with the remote server. It can be used by other
+// clients to join this connection (see WithJoin)
+func (c *Client) ConnectionID() string {
+	return c.session.connectionID()
+}
+
 // OnSync sets a function that will be called on every sync instruction received. This event
 // usually happens after a batch of updates are received from the guacd server, making it a
 // perfect way to get the current screenshot without having to poll with Screen().
@@ -77,6 +192,57 @@ func (c *Client) OnSync(f OnSyncFunc) {
 	c.onSync = f
 }
 
+// OnError sets a function that will be called when the server reports an error. Errors reported
+// by the server are fatal, so the session is terminated after the handler is called, and the error
+// is also returned by Run
+func (c *Client) OnError(f OnErrorFunc) {
+	c.onError = f
+}
+
+// OnStateChange sets a function that will be called every time the session state changes. The
+// handler is called from the goroutine that caused the change, so avoid adding any blocking behaviour.
+// See WithStateChange to also be notified of the changes while the Client is connecting
+func (c *Client) OnStateChange(f OnStateChangeFunc) {
+	c.session.setOnStateChange(f)
+}
+
+// OnReconnect sets a function that will be called on every reconnection attempt, and when the
+// reconnection succeeds. Only used if the Client was created with the WithReconnect option. The handler
+// is called from the goroutine handling the reconnection, so avoid adding any blocking behaviour
+func (c *Client) OnReconnect(f OnReconnectFunc) {
+	c.session.setOnReconnect(f)
+}
+
+// OnRequired sets a function that will be called when the server needs additional parameters to
+// continue the connection, like credentials not provided in the configuration (ex: RDP with NLA).
+// The values returned are sent back to the server. If no handler is set, the request is ignored
+func (c *Client) OnRequired(f OnRequiredFunc) {
+	c.onRequired = f
+}
+
+// OnClipboard sets a function that will be called every time the clipboard of the remote
+// session changes
+func (c *Client) OnClipboard(f OnClipboardFunc) {
+	c.onClipboard = f
+}
+
+// SetClipboard sets the contents of the remote session's clipboard. Usually the mimetype is
+// "text/plain", as it is the only one supported by most remote protocols
+func (c *Client) SetClipboard(mimetype string, data []byte) error {
+	if c.session.getState() != SessionActive {
+		return ErrNotConnected
+	}
+
+	s := c.streams.open()
+	defer c.streams.close(s)
+
+	err := c.streams.write(s, protocol.NewInstruction("clipboard", strconv.Itoa(s.index), mimetype))
+	if err != nil {
+		return err
+	}
+	return c.writeStream(s, data)
+}
+
 // Screen returns a snapshot of the current screen, together with the last updated timestamp
 func (c *Client) Screen() (image image.Image, lastUpdate int64) {
 	return c.display.getCanvas()
@@ -84,13 +250,27 @@ func (c *Client) Screen() (image image.Image, lastUpdate int64) {
 
 // State returns the current session state
 func (c *Client) State() SessionState {
-	return c.session.State
+	return c.session.getState()
+}
+
+// Resize requests the server to change the size of the remote display. If dpi is not positive, the
+// current DPI is kept. The change is not immediate: the screen is resized only after the
+// server processes the request and sends the new size, and only if the remote protocol supports it
+// (ex: RDP with display updates enabled by the "resize-method" parameter)
+func (c *Client) Resize(width, height, dpi int) error {
+	if c.session.getState() != SessionActive {
+		return ErrNotConnected
+	}
+	if width <= 0 || height <= 0 {
+		return ErrInvalidSize
+	}
+	return c.session.resize(width, height, dpi)
 }
 
 // SendMouse sends mouse events to the server. An event is composed by position of the
 // cursor, and a list of any currently pressed MouseButtons
 func (c *Client) SendMouse(p image.Point, pressedButtons ...MouseButton) error {
-	if c.session.State != SessionActive {
+	if c.session.getState() != SessionActive {
 		return ErrNotConnected
 	}
 
@@ -109,7 +289,7 @@ func (c *Client) SendMouse(p image.Point, pressedButtons ...MouseButton) error {
 // SendText sends the sequence of characters as they were typed. Only works with simple chars
 // (no combination with control keys)
 func (c *Client) SendText(sequence string) error {
-	if c.session.State != SessionActive {
+	if c.session.getState() != SessionActive {
 		return ErrNotConnected
 	}
 
@@ -129,7 +309,7 @@ func (c *Client) SendText(sequence string) error {
 
 // SendKey sends key presses and releases.
 func (c *Client) SendKey(key KeyCode, pressed bool) error {
-	if c.session.State != SessionActive {
+	if c.session.getState() != SessionActive {
 		return ErrNotConnected
 	}
 
@@ -150,3 +330,36 @@ func (c *Client) SendKey(key KeyCode, pressed bool) error {
 	}
 	return c.session.Send(instructions...)
 }
+
+// sendArgument sends the value of a connection parameter to the server, using an "argv" stream
+func (c *Client) sendArgument(name, value string) error {
+	s := c.streams.open()
+	defer c.streams.close(s)
+
+	err := c.streams.write(s, protocol.NewInstruction("argv", strconv.Itoa(s.index), "text/plain", name))
+	if err != nil {
+		return err
+	}
+	return c.writeStream(s, []byte(value))
+}
+
+// writeStream sends the data through the outbound stream, split in blobs, and then ends the stream. It does
+// not wait for acknowledgements, but stops sending if the server already reported an error for the stream
+func (c *Client) writeStream(s *outputStream, data []byte) error {
+	index := strconv.Itoa(s.index)
+	for len(data) > 0 {
+		if err := s.Err(); err != nil {
+			return err
+		}
+		n := len(data)
+		if n > maxBlobLength {
+			n = maxBlobLength
+		}
+		blob := base64.StdEncoding.EncodeToString(data[:n])
+		if err := c.streams.write(s, protocol.NewInstruction("blob", index, blob)); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return c.session.Send(protocol.NewInstruction("end", index))
+}
@@ -1,9 +1,16 @@
 package bring
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
 	"image"
+	"image/color"
+	"io"
 	"math"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/deluan/bring/protocol"
 	. "github.com/onsi/ginkgo"
@@ -17,31 +24,35 @@ var _ = Describe("Client", func() {
 
 	BeforeEach(func() {
 		t = &mockTunnel{}
-		l := &DefaultLogger{Quiet: true}
-		s = &session{
-			In:       make(chan *protocol.Instruction, 100),
-			State:    SessionActive,
-			done:     make(chan bool),
-			logger:   l,
-			tunnel:   t,
-			protocol: "vnc",
-		}
-		c = &Client{
-			session: s,
-			display: newDisplay(l),
-			streams: newStreams(),
-			logger:  l,
-		}
+		c = newTestClient(t)
+		s = c.session
+		s.protocol = "vnc"
 	})
 
 	Context("Active session", func() {
 		It("exposes the session state", func() {
-			s.State = SessionHandshake
+			s.setState(SessionHandshake)
 			Expect(c.State()).To(Equal(SessionHandshake))
-			s.State = SessionClosed
+			s.setState(SessionClosed)
 			Expect(c.State()).To(Equal(SessionClosed))
 		})
 
+		It("notifies all state changes", func() {
+			var states []SessionState
+			c.OnStateChange(func(state, previous SessionState) {
+				states = append(states, previous, state)
+			})
+			s.setState(SessionActive)
+			s.setState(SessionHandshake)
+			s.setState(SessionHandshake)
+			c.Close()
+
+			Expect(states).To(Equal([]SessionState{
+				SessionActive, SessionHandshake,
+				SessionHandshake, SessionClosed,
+			}))
+		})
+
 		It("sends the mouse position to the remote server", func() {
 			err := c.SendMouse(image.Pt(10, 20))
 			Expect(err).To(BeNil())
@@ -98,9 +109,325 @@ var _ = Describe("Client", func() {
 		})
 	})
 
+	Context("Lifecycle", func() {
+		It("returns from Run when the context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			errC := make(chan error)
+			go func() { errC <- c.Run(ctx) }()
+
+			cancel()
+			Eventually(errC).Should(Receive(Equal(context.Canceled)))
+			Expect(c.State()).To(Equal(SessionClosed))
+			Expect(t.disconnected).To(BeTrue())
+		})
+
+		It("returns from Run when the client is closed", func() {
+			errC := make(chan error)
+			go func() { errC <- c.Run(context.Background()) }()
+
+			c.Close()
+			Eventually(errC).Should(Receive(BeNil()))
+			Expect(t.sent).To(ContainElement(protocol.NewInstruction("disconnect")))
+		})
+
+		It("closes the Done channel when the session ends", func() {
+			Expect(c.Done()).ToNot(BeClosed())
+			c.Close()
+			Expect(c.Done()).To(BeClosed())
+		})
+
+		It("returns from Start when the session input is closed", func() {
+			finished := make(chan bool)
+			go func() {
+				c.Start()
+				close(finished)
+			}()
+
+			s.Terminate()
+			close(s.In)
+			Eventually(finished).Should(BeClosed())
+		})
+
+		It("returns the error that terminated the session", func() {
+			readErr := errors.New("connection reset")
+			errC := make(chan error)
+			go func() { errC <- c.Run(context.Background()) }()
+
+			s.terminate(readErr)
+			Eventually(errC).Should(Receive(Equal(readErr)))
+		})
+	})
+
+	Context("Server errors", func() {
+		It("reports the error and terminates the session", func() {
+			var reported *ServerError
+			c.OnError(func(err *ServerError) {
+				reported = err
+			})
+			errC := make(chan error)
+			go func() { errC <- c.Run(context.Background()) }()
+
+			s.In <- protocol.NewInstruction("error", "Authentication failure", "769")
+
+			var err error
+			Eventually(errC).Should(Receive(&err))
+			Expect(err).To(Equal(&ServerError{Status: StatusClientUnauthorized, Message: "Authentication failure"}))
+			Expect(reported).To(Equal(err))
+			Expect(c.State()).To(Equal(SessionClosed))
+		})
+	})
+
+	Context("Display size", func() {
+		BeforeEach(func() {
+			s.width, s.height, s.dpi = 1024, 768, 96
+		})
+
+		It("requests the server to resize the display", func() {
+			Expect(c.Resize(800, 600, 0)).To(Succeed())
+			Expect(c.Resize(1920, 1080, 144)).To(Succeed())
+
+			Expect(t.sent).To(Equal([]*protocol.Instruction{
+				protocol.NewInstruction("size", "800", "600", "96"),
+				protocol.NewInstruction("size", "1920", "1080", "144"),
+			}))
+			Expect(s.sizeInstruction()).To(Equal(protocol.NewInstruction("size", "1920", "1080", "144")))
+		})
+
+		It("does not accept invalid sizes", func() {
+			Expect(c.Resize(0, 600, 0)).To(Equal(ErrInvalidSize))
+			Expect(t.sent).To(BeEmpty())
+		})
+
+		It("resizes the screen when the server changes the display size", func() {
+			Expect(handlers["size"](c, []string{"0", "1024", "768"})).To(Succeed())
+			Expect(handlers["sync"](c, []string{"1"})).To(Succeed())
+			img, _ := c.Screen()
+			Expect(img.Bounds()).To(Equal(image.Rect(0, 0, 1024, 768)))
+
+			Expect(handlers["size"](c, []string{"0", "800", "600"})).To(Succeed())
+			Expect(handlers["sync"](c, []string{"2"})).To(Succeed())
+			img, _ = c.Screen()
+			Expect(img.Bounds()).To(Equal(image.Rect(0, 0, 800, 600)))
+		})
+	})
+
+	Context("Drawing", func() {
+		It("draws paths sent by the server", func() {
+			instructions := [][]string{
+				{"size", "0", "100", "100"},
+				{"push", "0"},
+				{"transform", "0", "1", "0", "0", "1", "10.5", "0"},
+				{"start", "0", "0", "50"},
+				{"line", "0", "50", "50"},
+				{"cstroke", "14", "0", "0", "1", "10", "255", "0", "0", "255"},
+				{"pop", "0"},
+				{"arc", "0", "80", "80", "10", "0", "6.2832", "0"},
+				{"cfill", "14", "0", "0", "0", "255", "255"},
+				{"sync", "1"},
+			}
+			for _, ins := range instructions {
+				Expect(handlers[ins[0]](c, ins[1:])).To(Succeed())
+			}
+
+			img, _ := c.Screen()
+			Expect(img.At(5, 50)).To(Equal(color.RGBA{}))
+			Expect(img.At(30, 52)).To(Equal(color.RGBA{255, 0, 0, 255}))
+			Expect(img.At(80, 80)).To(Equal(color.RGBA{0, 0, 255, 255}))
+		})
+
+		It("draws images received in streams, without acknowledging them", func() {
+			png := "iVBORw0KGgoAAAANSUhEUgAAAAEAAAAPAgMAAABYcU1qAAAACVBMVEX8/Pzc3Nzr6+uSJe5dAAAAEUlEQVQImWNgAAIHhgYGrAAAEd4AwbcvDeEAAAAASUVORK5CYII="
+			instructions := [][]string{
+				{"size", "0", "10", "20"},
+				{"img", "5", "14", "0", "image/png", "2", "3"},
+				{"blob", "5", png[:40]},
+				{"blob", "5", png[40:]},
+				{"end", "5"},
+				{"sync", "1"},
+			}
+			for _, ins := range instructions {
+				Expect(handlers[ins[0]](c, ins[1:])).To(Succeed())
+			}
+
+			img, _ := c.Screen()
+			Expect(img.At(2, 3)).ToNot(Equal(color.RGBA{}))
+			Expect(img.At(3, 3)).To(Equal(color.RGBA{}))
+			Expect(t.sent).To(Equal([]*protocol.Instruction{protocol.NewInstruction("sync", "1")}))
+		})
+
+		It("composites visible layers, with their position and opacity", func() {
+			red, green, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}, color.RGBA{0, 0, 255, 255}
+			instructions := [][]string{
+				{"size", "0", "100", "100"},
+				{"rect", "0", "0", "0", "100", "100"},
+				{"cfill", "14", "0", "0", "0", "255", "255"},
+				{"size", "1", "20", "20"},
+				{"rect", "1", "0", "0", "20", "20"},
+				{"cfill", "14", "1", "255", "0", "0", "255"},
+				{"move", "1", "0", "10", "10", "0"},
+				{"size", "2", "20", "20"},
+				{"rect", "2", "0", "0", "20", "20"},
+				{"cfill", "14", "2", "0", "255", "0", "255"},
+				{"move", "2", "1", "15", "15", "0"},
+				{"sync", "1"},
+			}
+			for _, ins := range instructions {
+				Expect(handlers[ins[0]](c, ins[1:])).To(Succeed())
+			}
+
+			img, _ := c.Screen()
+			Expect(img.At(5, 5)).To(Equal(blue))
+			Expect(img.At(12, 12)).To(Equal(red))
+			Expect(img.At(27, 27)).To(Equal(green))
+			Expect(img.At(32, 32)).To(Equal(blue), "children are clipped by their parents")
+
+			Expect(handlers["shade"](c, []string{"1", "128"})).To(Succeed())
+			Expect(handlers["move"](c, []string{"2", "0", "50", "50", "0"})).To(Succeed())
+			Expect(handlers["sync"](c, []string{"2"})).To(Succeed())
+			Expect(img.At(12, 12)).To(Equal(color.RGBA{128, 0, 127, 255}))
+			Expect(img.At(27, 27)).To(Equal(color.RGBA{128, 0, 127, 255}))
+			Expect(img.At(55, 55)).To(Equal(green))
+
+			Expect(handlers["dispose"](c, []string{"1"})).To(Succeed())
+			Expect(handlers["sync"](c, []string{"3"})).To(Succeed())
+			Expect(img.At(12, 12)).To(Equal(blue))
+			Expect(img.At(55, 55)).To(Equal(green))
+		})
+
+		It("moves the cursor while instructions are handled", func() {
+			cursor := [][]string{
+				{"size", "0", "100", "100"},
+				{"rect", "-1", "0", "0", "8", "8"},
+				{"cfill", "14", "-1", "0", "0", "0", "255"},
+				{"cursor", "0", "0", "-1", "0", "0", "8", "8"},
+				{"sync", "0"},
+			}
+			for _, ins := range cursor {
+				Expect(handlers[ins[0]](c, ins[1:])).To(Succeed())
+			}
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 200; i++ {
+					_ = c.SendMouse(image.Pt(i%100, i%100))
+				}
+			}()
+
+		loop:
+			for i := 1; ; i++ {
+				layer := strconv.Itoa(i%10 + 1)
+				instructions := [][]string{
+					{"rect", layer, "0", "0", "20", "20"},
+					{"cfill", "14", layer, "255", "0", "0", "255"},
+					{"move", layer, "0", "10", "10", "0"},
+					{"sync", strconv.Itoa(i)},
+					{"dispose", layer},
+				}
+				for _, ins := range instructions {
+					Expect(handlers[ins[0]](c, ins[1:])).To(Succeed())
+				}
+				select {
+				case <-done:
+					break loop
+				default:
+				}
+			}
+		})
+	})
+
+	Context("Clipboard", func() {
+		It("receives the remote clipboard contents", func() {
+			var mimetype string
+			var data []byte
+			c.OnClipboard(func(m string, d []byte) {
+				mimetype, data = m, d
+			})
+
+			Expect(handlers["clipboard"](c, []string{"3", "text/plain"})).To(Succeed())
+			Expect(handlers["blob"](c, []string{"3", "YnJpbmcg"})).To(Succeed())
+			Expect(handlers["blob"](c, []string{"3", "aXQgb24="})).To(Succeed())
+			Expect(handlers["end"](c, []string{"3"})).To(Succeed())
+
+			Expect(mimetype).To(Equal("text/plain"))
+			Expect(string(data)).To(Equal("bring it on"))
+			Expect(t.sent).To(Equal([]*protocol.Instruction{
+				protocol.NewInstruction("ack", "3", "OK", "0"),
+				protocol.NewInstruction("ack", "3", "OK", "0"),
+			}))
+		})
+
+		It("sends large contents split in multiple blobs", func() {
+			data := []byte(strings.Repeat("x", maxBlobLength+10))
+			Expect(c.SetClipboard("text/plain", data)).To(Succeed())
+
+			Expect(t.sent).To(HaveLen(4))
+			Expect(t.sent[0]).To(Equal(protocol.NewInstruction("clipboard", "0", "text/plain")))
+			Expect(t.sent[1].Opcode).To(Equal("blob"))
+			Expect(t.sent[2]).To(Equal(protocol.NewInstruction("blob", "0", base64.StdEncoding.EncodeToString(data[maxBlobLength:]))))
+			Expect(t.sent[3]).To(Equal(protocol.NewInstruction("end", "0")))
+
+			var sent []byte
+			for _, blob := range t.sent[1:3] {
+				decoded, _ := base64.StdEncoding.DecodeString(blob.Args[1])
+				sent = append(sent, decoded...)
+			}
+			Expect(sent).To(Equal(data))
+		})
+
+		It("does not reuse the stream index before the server acknowledges it", func() {
+			Expect(c.SetClipboard("text/plain", []byte("abc"))).To(Succeed())
+
+			s := c.streams.open()
+			Expect(s.index).To(Equal(1))
+			Expect(handlers["ack"](c, []string{"0", "Clipboard unsupported", "256"})).To(Succeed())
+			Expect(s.Err()).To(BeNil())
+		})
+	})
+
+	Context("Required parameters", func() {
+		It("sends the values provided by the handler as argv streams", func() {
+			var requested []string
+			c.OnRequired(func(parameters []string) map[string]string {
+				requested = parameters
+				return map[string]string{"username": "user", "password": "secret"}
+			})
+
+			Expect(handlers["required"](c, []string{"username", "password", "domain"})).To(Succeed())
+
+			Expect(requested).To(Equal([]string{"username", "password", "domain"}))
+			Expect(t.sent).To(Equal([]*protocol.Instruction{
+				protocol.NewInstruction("argv", "0", "text/plain", "username"),
+				protocol.NewInstruction("blob", "0", "dXNlcg=="),
+				protocol.NewInstruction("end", "0"),
+				protocol.NewInstruction("argv", "1", "text/plain", "password"),
+				protocol.NewInstruction("blob", "1", "c2VjcmV0"),
+				protocol.NewInstruction("end", "1"),
+			}))
+		})
+
+		It("ignores the request if there is no handler", func() {
+			Expect(handlers["required"](c, []string{"password"})).To(Succeed())
+			Expect(t.sent).To(BeEmpty())
+		})
+
+		It("ignores the request from servers older than 1.3.0", func() {
+			called := false
+			c.OnRequired(func(parameters []string) map[string]string {
+				called = true
+				return map[string]string{"password": "secret"}
+			})
+			s.setVersion(protocol.Version110)
+
+			Expect(handlers["required"](c, []string{"password"})).To(Succeed())
+			Expect(called).To(BeFalse())
+			Expect(t.sent).To(BeEmpty())
+		})
+	})
+
 	Context("Session is disconnected", func() {
 		BeforeEach(func() {
-			s.State = SessionClosed
+			s.setState(SessionClosed)
 		})
 
 		It("does not send anything", func() {
@@ -112,20 +439,154 @@ var _ = Describe("Client", func() {
 
 			err = c.SendMouse(image.Pt(0, 0), MouseRight)
 			Expect(err).To(Equal(ErrNotConnected))
+
+			err = c.Resize(800, 600, 96)
+			Expect(err).To(Equal(ErrNotConnected))
+
+			err = c.SetClipboard("text/plain", []byte("abc"))
+			Expect(err).To(Equal(ErrNotConnected))
 		})
 	})
 })
 
+var _ = Describe("NewClientWithOptions", func() {
+	var server *fakeServer
+
+	BeforeEach(func() {
+		server = &fakeServer{
+			replies: map[string]string{
+				"select":  "4.args,8.hostname;",
+				"connect": "5.ready,21.$unique-connection-id;",
+			},
+		}
+	})
+
+	It("requires a tunnel", func() {
+		_, err := NewClientWithOptions("vnc", nil, WithLogger(&DefaultLogger{Quiet: true}))
+		Expect(err).To(Equal(ErrNoTunnel))
+	})
+
+	It("uses the tunnel provided", func() {
+		t, _ := protocol.NewInetSocketTunnel(server.start())
+		c, err := NewClientWithOptions("vnc", nil, WithTunnel(t), WithLogger(&DefaultLogger{Quiet: true}))
+		Expect(err).To(BeNil())
+		Expect(c.session.tunnel).To(BeIdenticalTo(t))
+	})
+
+	It("returns the error from the dialer", func() {
+		dialErr := errors.New("dial error")
+		_, err := NewClientWithOptions("vnc", nil, WithLogger(&DefaultLogger{Quiet: true}),
+			WithDialer(func() (protocol.Tunnel, error) {
+				return nil, dialErr
+			}))
+		Expect(err).To(Equal(dialErr))
+	})
+})
+
+var _ = Describe("Server ending the session", func() {
+	connect := func(ins ...*protocol.Instruction) *Client {
+		handshake := []*protocol.Instruction{
+			protocol.NewInstruction("args", "hostname"),
+			protocol.NewInstruction("ready", "$unique-connection-id"),
+		}
+		t := newScriptedTunnel(append(handshake, ins...)...)
+		c, err := NewClientWithOptions("vnc", nil, WithTunnel(t), WithLogger(&DefaultLogger{Quiet: true}))
+		Expect(err).To(BeNil())
+		return c
+	}
+
+	It("returns the error sent right before the connection is closed", func() {
+		c := connect(protocol.NewInstruction("error", "Authentication failure", "769"))
+		var reported *ServerError
+		c.OnError(func(err *ServerError) {
+			reported = err
+		})
+
+		err := c.Run(context.Background())
+		expected := &ServerError{Status: StatusClientUnauthorized, Message: "Authentication failure"}
+		Expect(err).To(Equal(expected))
+		Expect(reported).To(Equal(expected))
+	})
+
+	It("ends normally when disconnected right before the connection is closed", func() {
+		c := connect(protocol.NewInstruction("disconnect"))
+		Expect(c.Run(context.Background())).To(Succeed())
+	})
+})
+
 func toAscii(c int32) string {
 	return strconv.Itoa(int(c))
 }
 
+// newTestClient returns a Client with an active session, which sends all instructions to the tunnel
+func newTestClient(t *mockTunnel) *Client {
+	l := &DefaultLogger{Quiet: true}
+	s := &session{
+		In:      make(chan *protocol.Instruction, 100),
+		state:   SessionActive,
+		done:    make(chan struct{}),
+		logger:  l,
+		tunnel:  t,
+		version: protocol.LatestVersion,
+	}
+	return &Client{
+		session: s,
+		display: newDisplay(l),
+		streams: newStreamManager(s.Send, l),
+		logger:  l,
+	}
+}
+
+// scriptedTunnel receives the instructions provided, as if sent by the server, and then reports
+// the connection was closed
+type scriptedTunnel struct {
+	mockTunnel
+	received chan *protocol.Instruction
+}
+
+func newScriptedTunnel(ins ...*protocol.Instruction) *scriptedTunnel {
+	t := &scriptedTunnel{received: make(chan *protocol.Instruction, len(ins))}
+	for _, i := range ins {
+		t.received <- i
+	}
+	close(t.received)
+	return t
+}
+
+func (st *scriptedTunnel) Connect(string) error {
+	return nil
+}
+
+func (st *scriptedTunnel) ReceiveInstruction() (*protocol.Instruction, error) {
+	ins, ok := <-st.received
+	if !ok {
+		return nil, io.EOF
+	}
+	return ins, nil
+}
+
 type mockTunnel struct {
 	protocol.Tunnel
-	sent []*protocol.Instruction
+	sync.Mutex
+	sent         []*protocol.Instruction
+	disconnected bool
+}
+
+// sentInstructions returns all instructions sent so far. Use it when instructions are sent
+// from other goroutines
+func (mt *mockTunnel) sentInstructions() []*protocol.Instruction {
+	mt.Lock()
+	defer mt.Unlock()
+	return append([]*protocol.Instruction{}, mt.sent...)
+}
+
+func (mt *mockTunnel) Disconnect() {
+	mt.disconnected = true
 }
 
 func (mt *mockTunnel) SendInstruction(ins ...*protocol.Instruction) error {
+	mt.Lock()
+	defer mt.Unlock()
 	mt.sent = append(mt.sent, ins...)
 	return nil
 }
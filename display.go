@@ -3,17 +3,14 @@ package bring
 import (
 	"fmt"
 	"image"
+	"image/color"
 	"image/draw"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-var compositeOperations = map[byte]draw.Op{
-	0xC: draw.Src,
-	0xE: draw.Over,
-}
-
 type display struct {
 	logger         Logger
 	cursor         *layer
@@ -26,6 +23,13 @@ type display struct {
 	defaultLayer   *layer
 	canvas         *image.RGBA
 	lastUpdate     int64
+
+	// Area of the canvas to be rendered again, besides the areas modified in the layers
+	damage image.Rectangle
+
+	// Guards the layers, cursor and canvas, as the cursor is moved from the caller's goroutine
+	// while tasks are executed
+	mutex sync.Mutex
 }
 
 func newDisplay(logger Logger) *display {
@@ -39,6 +43,18 @@ func newDisplay(logger Logger) *display {
 	return d
 }
 
+// reset discards all layers, the cursor and any pending tasks. The canvas is kept, so the last screen
+// is still available until the server sends a new one
+func (d *display) reset() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.tasks = nil
+	d.cursor = newBuffer()
+	d.layers = newLayers()
+	d.defaultLayer = d.layers.getDefault()
+	d.damage = image.Rectangle{}
+}
+
 type taskFunc func() error
 
 type task struct {
@@ -66,44 +82,125 @@ func (d *display) processSingleTask(t task) {
 	err := t.taskFunc()
 	if err != nil {
 		d.logger.Errorf("Skipping task %s due to error. This can lead to invalid screen state! Error: %s", t.String(), err)
-		return
 	}
-	if !d.defaultLayer.modified {
-		return
-	}
-	// TODO Only update canvas after all tasks are applied?
-	mr := d.defaultLayer.modifiedRect
-	copyImage(d.canvas, mr.Min.X, mr.Min.Y, d.defaultLayer.image, mr, draw.Src)
-	d.lastUpdate = time.Now().UnixNano()
-
-	d.defaultLayer.resetModified()
 }
 
 func (d *display) flush() {
 	if len(d.tasks) == 0 {
 		return
 	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	d.logger.Tracef("Processing %d pending tasks", len(d.tasks))
 	for _, t := range d.tasks {
 		d.processSingleTask(t)
 	}
 	d.logger.Tracef("All pending tasks were completed")
 	d.tasks = nil
+	d.updateCanvas()
+}
+
+// updateCanvas renders again all areas of the canvas changed since the last update
+func (d *display) updateCanvas() {
+	damage := d.damage
+	for _, l := range d.layers {
+		if !l.modified {
+			continue
+		}
+		if r, ok := d.layers.toScreen(l, l.modifiedRect); ok {
+			damage = damage.Union(r)
+		}
+		l.resetModified()
+	}
+	d.damage = image.Rectangle{}
+	d.render(damage)
+}
+
+// render draws the area r of the canvas, compositing all layers displayed and the cursor
+func (d *display) render(r image.Rectangle) {
+	r = r.Intersect(d.canvas.Bounds())
+	if r.Empty() {
+		return
+	}
+	draw.Draw(d.canvas, r, image.Transparent, image.Point{}, draw.Src)
+	d.renderLayer(d.defaultLayer, image.Point{}, 0xff, r)
+
+	cr := d.cursorRect().Intersect(r)
+	draw.Draw(d.canvas, cr, d.cursor.image, cr.Min.Sub(image.Pt(d.cursorX, d.cursorY)), draw.Over)
+	d.lastUpdate = time.Now().UnixNano()
+}
+
+// renderLayer draws the layer and its children inside the area clip of the canvas. The opacity of
+// the parents is applied to each layer separately, so overlapping children of a translucent layer
+// are blended with each other, instead of being shaded as a group
+func (d *display) renderLayer(l *layer, origin image.Point, opacity uint8, clip image.Rectangle) {
+	opacity = uint8(uint32(opacity) * uint32(l.opacity) / 0xff)
+	if opacity == 0 {
+		return
+	}
+	pos := origin.Add(image.Pt(l.x, l.y))
+	clip = clip.Intersect(l.image.Bounds().Add(pos))
+	if clip.Empty() {
+		return
+	}
+
+	var mask image.Image
+	if opacity != 0xff {
+		mask = image.NewUniform(color.Alpha{A: opacity})
+	}
+	draw.DrawMask(d.canvas, clip, l.image, clip.Min.Sub(pos), mask, image.Point{}, draw.Over)
+	for _, child := range d.layers.children(l) {
+		d.renderLayer(child, pos, opacity, clip)
+	}
+}
+
+// damageLayer marks the area of the screen displaying the layer to be rendered again
+func (d *display) damageLayer(l *layer) {
+	if r, ok := d.layers.toScreen(l, l.image.Bounds()); ok {
+		d.damage = d.damage.Union(r)
+	}
 }
 
 func (d *display) getCanvas() (image.Image, int64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	return d.canvas, d.lastUpdate
 }
 
 func (d *display) dispose(layerIdx int) {
 	d.scheduleTask("dispose", func() error {
+		if l, ok := d.layers[layerIdx]; ok && layerIdx != 0 {
+			d.damageLayer(l)
+		}
 		d.layers.delete(layerIdx)
 		return nil
 	})
 }
 
+func (d *display) move(layerIdx, parentIdx, x, y, z int) {
+	d.scheduleTask("move", func() error {
+		if layerIdx <= 0 || parentIdx < 0 {
+			return fmt.Errorf("layer %d can't be moved into %d", layerIdx, parentIdx)
+		}
+		l := d.layers.get(layerIdx)
+		d.damageLayer(l)
+		if !l.Move(d.layers.get(parentIdx), x, y, z) {
+			return fmt.Errorf("layer %d can't be moved into its own child %d", layerIdx, parentIdx)
+		}
+		d.damageLayer(l)
+		return nil
+	})
+}
+
+func (d *display) shade(layerIdx int, opacity byte) {
+	d.onLayer("shade", layerIdx, func(l *layer) {
+		l.Shade(opacity)
+		d.damageLayer(l)
+	})
+}
+
 func (d *display) copy(srcL, srcX, srcY, srcWidth, srcHeight, dstL, dstX, dstY int, compositeOperation byte) {
-	op := compositeOperations[compositeOperation]
+	op := channelMask(compositeOperation)
 	d.scheduleTask("copy", func() error {
 		srcLayer := d.layers.get(srcL)
 		dstLayer := d.layers.get(dstL)
@@ -113,11 +210,7 @@ func (d *display) copy(srcL, srcX, srcY, srcWidth, srcHeight, dstL, dstX, dstY i
 }
 
 func (d *display) draw(layerIdx, x, y int, compositeOperation byte, s *stream) {
-	op, ok := compositeOperations[compositeOperation]
-	if !ok {
-		d.logger.Warnf("Composite Operation not supported: %x", compositeOperation)
-		op = draw.Over
-	}
+	op := channelMask(compositeOperation)
 	img, err := s.image()
 
 	d.scheduleTask("draw", func() error {
@@ -130,8 +223,17 @@ func (d *display) draw(layerIdx, x, y int, compositeOperation byte, s *stream) {
 	})
 }
 
+// drawFrame draws a decoded video frame on the layer, replacing its contents
+func (d *display) drawFrame(layerIdx int, frame image.Image) {
+	d.scheduleTask("drawFrame", func() error {
+		layer := d.layers.get(layerIdx)
+		layer.Draw(0, 0, frame, compSrc)
+		return nil
+	})
+}
+
 func (d *display) fill(layerIdx int, r, g, b, a, compositeOperation byte) {
-	op := compositeOperations[compositeOperation]
+	op := channelMask(compositeOperation)
 	d.scheduleTask("fill", func() error {
 		layer := d.layers.get(layerIdx)
 		layer.Fill(r, g, b, a, op)
@@ -146,40 +248,116 @@ func (d *display) rect(layerIdx int, x int, y int, width int, height int) {
 	})
 }
 
+// onLayer schedules an operation on the layer
+func (d *display) onLayer(name string, layerIdx int, f func(l *layer)) {
+	d.scheduleTask(name, func() error {
+		f(d.layers.get(layerIdx))
+		return nil
+	})
+}
+
+func (d *display) start(layerIdx int, x, y float64) {
+	d.onLayer("start", layerIdx, func(l *layer) { l.Start(x, y) })
+}
+
+func (d *display) line(layerIdx int, x, y float64) {
+	d.onLayer("line", layerIdx, func(l *layer) { l.Line(x, y) })
+}
+
+func (d *display) curve(layerIdx int, cp1x, cp1y, cp2x, cp2y, x, y float64) {
+	d.onLayer("curve", layerIdx, func(l *layer) { l.Curve(cp1x, cp1y, cp2x, cp2y, x, y) })
+}
+
+func (d *display) arc(layerIdx int, x, y, radius, start, end float64, negative bool) {
+	d.onLayer("arc", layerIdx, func(l *layer) { l.Arc(x, y, radius, start, end, negative) })
+}
+
+func (d *display) closePath(layerIdx int) {
+	d.onLayer("close", layerIdx, func(l *layer) { l.Close() })
+}
+
+func (d *display) stroke(layerIdx, lineCap, lineJoin int, thickness float64, r, g, b, a, compositeOperation byte) {
+	op := channelMask(compositeOperation)
+	d.onLayer("cstroke", layerIdx, func(l *layer) { l.Stroke(lineCap, lineJoin, thickness, r, g, b, a, op) })
+}
+
+func (d *display) fillLayer(layerIdx, srcL int, compositeOperation byte) {
+	op := channelMask(compositeOperation)
+	d.onLayer("lfill", layerIdx, func(l *layer) { l.FillLayer(d.layers.get(srcL), op) })
+}
+
+func (d *display) strokeLayer(layerIdx, lineCap, lineJoin int, thickness float64, srcL int, compositeOperation byte) {
+	op := channelMask(compositeOperation)
+	d.onLayer("lstroke", layerIdx, func(l *layer) {
+		l.StrokeLayer(lineCap, lineJoin, thickness, d.layers.get(srcL), op)
+	})
+}
+
+func (d *display) clip(layerIdx int) {
+	d.onLayer("clip", layerIdx, func(l *layer) { l.Clip() })
+}
+
+func (d *display) push(layerIdx int) {
+	d.onLayer("push", layerIdx, func(l *layer) { l.Push() })
+}
+
+func (d *display) pop(layerIdx int) {
+	d.onLayer("pop", layerIdx, func(l *layer) { l.Pop() })
+}
+
+func (d *display) resetLayer(layerIdx int) {
+	d.onLayer("reset", layerIdx, func(l *layer) { l.Reset() })
+}
+
+func (d *display) set(layerIdx int, property string, value float64) {
+	d.onLayer("set", layerIdx, func(l *layer) {
+		if !l.Set(property, value) {
+			d.logger.Warnf("Layer property not supported: %s", property)
+		}
+	})
+}
+
+func (d *display) identity(layerIdx int) {
+	d.onLayer("identity", layerIdx, func(l *layer) { l.Identity() })
+}
+
+func (d *display) transform(layerIdx int, xx, yx, xy, yy, x0, y0 float64) {
+	d.onLayer("transform", layerIdx, func(l *layer) { l.Transform(xx, yx, xy, yy, x0, y0) })
+}
+
 func (d *display) resize(layerIdx, w, h int) {
 	d.scheduleTask("resize", func() error {
 		layer := d.layers.get(layerIdx)
 		layer.Resize(w, h)
 		if layerIdx == 0 {
 			d.canvas = image.NewRGBA(layer.image.Bounds())
-			copyImage(d.canvas, 0, 0, layer.image, layer.image.Bounds(), draw.Src)
+			d.damage = d.canvas.Bounds()
 		}
 		return nil
 	})
 }
 
-func (d *display) hideCursor() {
-	cr := image.Rect(d.cursorX, d.cursorY, d.cursorX+d.cursor.width, d.cursorY+d.cursor.height)
-	copyImage(d.canvas, d.cursorX, d.cursorY, d.defaultLayer.image, cr, draw.Src)
+func (d *display) cursorRect() image.Rectangle {
+	return image.Rect(d.cursorX, d.cursorY, d.cursorX+d.cursor.width, d.cursorY+d.cursor.height)
 }
 
 func (d *display) moveCursor(x, y int) {
-	d.hideCursor()
-
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	previous := d.cursorRect()
 	d.cursorX = x
 	d.cursorY = y
-
-	copyImage(d.canvas, d.cursorX, d.cursorY, d.cursor.image, d.cursor.image.Bounds(), draw.Over)
-	d.lastUpdate = time.Now().UnixNano()
+	d.render(previous)
+	d.render(d.cursorRect())
 }
 
 func (d *display) setCursor(cursorHotspotX, cursorHotspotY, srcL, srcX, srcY, srcWidth, srcHeight int) {
 	d.scheduleTask("setCursor", func() error {
-		d.hideCursor()
+		d.damage = d.damage.Union(d.cursorRect())
 
 		layer := d.layers.get(srcL)
 		d.cursor.Resize(srcWidth, srcHeight)
-		d.cursor.Copy(layer, srcX, srcY, srcWidth, srcHeight, 0, 0, draw.Src)
+		d.cursor.Copy(layer, srcX, srcY, srcWidth, srcHeight, 0, 0, compSrc)
 		d.cursorHotspotX = cursorHotspotX
 		d.cursorHotspotY = cursorHotspotY
 
@@ -187,7 +365,7 @@ func (d *display) setCursor(cursorHotspotX, cursorHotspotY, srcL, srcX, srcY, sr
 		//d.cursorX = cursorHotspotX
 		//d.cursorY = cursorHotspotY
 
-		copyImage(d.canvas, d.cursorX, d.cursorY, d.cursor.image, d.cursor.image.Bounds(), draw.Over)
+		d.damage = d.damage.Union(d.cursorRect())
 		return nil
 	})
 }
@@ -8,6 +8,9 @@ import (
 
 const disconnectOpcode = "disconnect"
 
+// Opcode that makes the fake server close the connection without ending the session, as if it was lost
+const dropOpcode = "drop"
+
 type fakeServer struct {
 	replies          map[string]string
 	messagesReceived []string
@@ -40,6 +43,9 @@ func (s *fakeServer) handleRequest(conn net.Conn) {
 			return
 		}
 		opcode := recv.Opcode
+		if opcode == dropOpcode {
+			return
+		}
 
 		_, err = io.WriteRaw([]byte(s.replies[opcode]))
 		if err != nil {
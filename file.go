@@ -0,0 +1,202 @@
+package bring
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/deluan/bring/protocol"
+)
+
+// Number of decoded blobs of a download that can be waiting to be read, before the Client stops
+// processing new instructions. Usually only one is pending, as the server waits for the "ack"
+// of each blob before sending the next one
+const downloadQueueSize = 4
+
+var errDownloadAborted = errors.New("download aborted")
+
+// OnFileFunc is the signature for OnFile event handlers. It will receive the name and mimetype of the
+// file being sent by the server, and a Reader for its contents
+type OnFileFunc = func(name, mimetype string, r io.Reader)
+
+// OnFile sets a function that will be called when the server sends a file to the Client (ex: files
+// downloaded through RDP drive redirection or SFTP). The handler is called in its own goroutine, and must
+// read the file contents until EOF: the transfer progresses as the contents are read, and it is aborted
+// if the handler returns before reading all of it. If no handler is set, all files are refused
+func (c *Client) OnFile(f OnFileFunc) {
+	c.onFile = f
+}
+
+// UploadFile sends a file to the remote session (ex: to a drive redirected with RDP, or through SFTP).
+// The contents are read from r and sent in chunks, waiting for the server to acknowledge each one before
+// sending the next. If the server refuses the file or any chunk, the status sent by the server is returned
+// as a *StreamError. It blocks until the whole file is sent, and must not be called from an event handler,
+// as the acknowledgements would never be processed
+func (c *Client) UploadFile(name, mimetype string, r io.Reader) error {
+	if c.session.getState() != SessionActive {
+		return ErrNotConnected
+	}
+
+	s := c.streams.open()
+	defer c.streams.close(s)
+
+	err := c.upload(s, protocol.NewInstruction("file", strconv.Itoa(s.index), mimetype, name), r)
+	if err != nil {
+		c.logger.Errorf("Upload of '%s' failed: %s", name, err)
+	}
+	return err
+}
+
+// upload sends the instruction that creates the outbound stream, and then the contents read from r,
+// waiting for the server to acknowledge the stream and each blob sent
+func (c *Client) upload(s *outputStream, create *protocol.Instruction, r io.Reader) error {
+	index := strconv.Itoa(s.index)
+	if err := c.streams.write(s, create); err != nil {
+		return err
+	}
+
+	// The server acknowledges the stream before any blob is sent
+	if err := s.wait(c.session.done); err != nil {
+		return err
+	}
+
+	buf := make([]byte, maxBlobLength)
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := c.sendBlob(s, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			_ = c.session.Send(protocol.NewInstruction("end", index))
+			return readErr
+		}
+	}
+	return c.session.Send(protocol.NewInstruction("end", index))
+}
+
+// sendBlob sends the data through the outbound stream, in a single blob, and waits for the server to acknowledge it
+func (c *Client) sendBlob(s *outputStream, data []byte) error {
+	blob := base64.StdEncoding.EncodeToString(data)
+	if err := c.streams.write(s, protocol.NewInstruction("blob", strconv.Itoa(s.index), blob)); err != nil {
+		return err
+	}
+	return s.wait(c.session.done)
+}
+
+// download writes the blobs received in a stream to a pipe, acknowledging each one after it is
+// consumed by the reader. This way, flow control is kept and the file is never fully kept in memory
+type download struct {
+	client    *Client
+	idx       int
+	blobs     chan []byte
+	discarded chan struct{}
+	reader    *io.PipeReader
+	writer    *io.PipeWriter
+}
+
+func newDownload(c *Client, idx int) *download {
+	r, w := io.Pipe()
+	d := &download{
+		client:    c,
+		idx:       idx,
+		blobs:     make(chan []byte, downloadQueueSize),
+		discarded: make(chan struct{}),
+		reader:    r,
+		writer:    w,
+	}
+	go d.run()
+	return d
+}
+
+// accept acknowledges the stream, signaling the server to start sending its contents
+func (d *download) accept() error {
+	return d.client.streams.sendAck(d.idx, "Ready", StatusSuccess)
+}
+
+// receive is used as the onBlob handler of the stream
+func (d *download) receive(_ *stream, data string) error {
+	blob, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		d.client.logger.Errorf("Invalid data received for stream %d: %s", d.idx, err)
+		_ = d.writer.CloseWithError(err)
+		return d.client.streams.sendAck(d.idx, "Invalid data", StatusClientBadType)
+	}
+	select {
+	case d.blobs <- blob:
+	case <-d.discarded:
+	case <-d.client.session.done:
+	}
+	return nil
+}
+
+// end is used as the onEnd handler of the stream
+func (d *download) end(_ *stream) {
+	close(d.blobs)
+}
+
+// discard is used as the onDiscard handler of the stream, failing the reader with err
+func (d *download) discard(err error) {
+	_ = d.writer.CloseWithError(err)
+	close(d.discarded)
+}
+
+// listen makes the download handle the contents of the stream
+func (d *download) listen(s *stream) {
+	s.onBlob = d.receive
+	s.onEnd = d.end
+	s.onDiscard = d.discard
+}
+
+// ack acknowledges a blob, unless the stream was discarded, as its index can already be used by
+// a stream of the new connection
+func (d *download) ack(message string, status StatusCode) error {
+	select {
+	case <-d.discarded:
+		return nil
+	default:
+		return d.client.streams.sendAck(d.idx, message, status)
+	}
+}
+
+// abort is called when the reader is no longer interested in the file contents
+func (d *download) abort() {
+	_ = d.reader.CloseWithError(errDownloadAborted)
+}
+
+func (d *download) run() {
+	failed := false
+	for {
+		var blob []byte
+		var ok bool
+		select {
+		case blob, ok = <-d.blobs:
+		case <-d.discarded:
+			return
+		case <-d.client.session.done:
+			_ = d.writer.CloseWithError(ErrNotConnected)
+			return
+		}
+		if !ok {
+			_ = d.writer.Close()
+			return
+		}
+		if failed {
+			continue
+		}
+		if _, err := d.writer.Write(blob); err != nil {
+			failed = true
+			d.client.logger.Warnf("Download from stream %d aborted: %s", d.idx, err)
+			_ = d.ack(err.Error(), StatusResourceClosed)
+			continue
+		}
+		if err := d.ack("OK", StatusSuccess); err != nil {
+			d.client.logger.Errorf("Failed to acknowledge blob for stream %d: %s", d.idx, err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package bring
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/deluan/bring/protocol"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("File transfers", func() {
+	var c *Client
+	var t *mockTunnel
+
+	BeforeEach(func() {
+		t = &mockTunnel{}
+		c = newTestClient(t)
+	})
+
+	Describe("Downloads", func() {
+		It("accepts the file and streams its contents to the handler, acknowledging each blob", func() {
+			received := make(chan string)
+			c.OnFile(func(name, mimetype string, r io.Reader) {
+				data, err := ioutil.ReadAll(r)
+				Expect(err).To(BeNil())
+				received <- name + "|" + mimetype + "|" + string(data)
+			})
+
+			Expect(handlers["file"](c, []string{"5", "text/plain", "notes.txt"})).To(Succeed())
+			Expect(handlers["blob"](c, []string{"5", "YnJpbmcg"})).To(Succeed())
+			Expect(handlers["blob"](c, []string{"5", "aXQgb24="})).To(Succeed())
+			Expect(handlers["end"](c, []string{"5"})).To(Succeed())
+
+			Eventually(received).Should(Receive(Equal("notes.txt|text/plain|bring it on")))
+			Eventually(t.sentInstructions).Should(Equal([]*protocol.Instruction{
+				protocol.NewInstruction("ack", "5", "Ready", "0"),
+				protocol.NewInstruction("ack", "5", "OK", "0"),
+				protocol.NewInstruction("ack", "5", "OK", "0"),
+			}))
+		})
+
+		It("refuses files if there is no handler", func() {
+			Expect(handlers["file"](c, []string{"5", "text/plain", "notes.txt"})).To(Succeed())
+			Expect(t.sent).To(Equal([]*protocol.Instruction{
+				protocol.NewInstruction("ack", "5", "File transfer unsupported", "256"),
+			}))
+		})
+
+		It("aborts the transfer if the handler does not read the whole file", func() {
+			c.OnFile(func(name, mimetype string, r io.Reader) {
+				buf := make([]byte, 3)
+				_, _ = r.Read(buf)
+			})
+
+			Expect(handlers["file"](c, []string{"5", "text/plain", "notes.txt"})).To(Succeed())
+			Expect(handlers["blob"](c, []string{"5", "YnJpbmcg"})).To(Succeed())
+			Eventually(t.sentInstructions).Should(HaveLen(2))
+			Expect(t.sentInstructions()[1].Args[2]).To(Equal("518"))
+
+			Expect(handlers["blob"](c, []string{"5", "aXQgb24="})).To(Succeed())
+			Consistently(t.sentInstructions, "100ms").Should(HaveLen(2))
+		})
+
+		It("fails the reader when the connection is reestablished during the transfer", func() {
+			result := make(chan error)
+			c.OnFile(func(name, mimetype string, r io.Reader) {
+				_, err := ioutil.ReadAll(r)
+				result <- err
+			})
+
+			Expect(handlers["file"](c, []string{"5", "text/plain", "notes.txt"})).To(Succeed())
+			Expect(handlers["blob"](c, []string{"5", "YnJpbmcg"})).To(Succeed())
+			Eventually(t.sentInstructions).Should(HaveLen(2))
+			Expect(handlers[reconnectedOpcode](c, nil)).To(Succeed())
+
+			Eventually(result).Should(Receive(Equal(ErrStreamClosed)))
+			Consistently(t.sentInstructions, "100ms").Should(HaveLen(2))
+		})
+	})
+
+	Describe("Uploads", func() {
+		upload := func(contents string) chan error {
+			result := make(chan error, 1)
+			go func() {
+				result <- c.UploadFile("notes.txt", "text/plain", strings.NewReader(contents))
+			}()
+			return result
+		}
+		ack := func(status string) {
+			Expect(handlers["ack"](c, []string{"0", "OK", status})).To(Succeed())
+		}
+
+		It("sends the file contents, waiting for the server acknowledgements", func() {
+			result := upload("bring it on")
+
+			Eventually(t.sentInstructions).Should(HaveLen(1))
+			Expect(t.sentInstructions()[0]).To(Equal(protocol.NewInstruction("file", "0", "text/plain", "notes.txt")))
+			Consistently(t.sentInstructions, "50ms").Should(HaveLen(1))
+
+			ack("0")
+			Eventually(t.sentInstructions).Should(HaveLen(2))
+			Expect(t.sentInstructions()[1]).To(Equal(protocol.NewInstruction("blob", "0", "YnJpbmcgaXQgb24=")))
+			Consistently(result, "50ms").ShouldNot(Receive())
+
+			ack("0")
+			Eventually(result).Should(Receive(BeNil()))
+			Expect(t.sentInstructions()[2]).To(Equal(protocol.NewInstruction("end", "0")))
+		})
+
+		It("returns the status sent by the server when the file is refused", func() {
+			result := upload("bring it on")
+
+			Eventually(t.sentInstructions).Should(HaveLen(1))
+			ack("771")
+
+			var err error
+			Eventually(result).Should(Receive(&err))
+			Expect(err).To(Equal(&StreamError{Index: 0, Status: StatusClientForbidden, Message: "OK"}))
+			Expect(t.sentInstructions()).To(HaveLen(1))
+		})
+
+		It("fails if the session is closed while waiting for an acknowledgement", func() {
+			result := upload("bring it on")
+
+			Eventually(t.sentInstructions).Should(HaveLen(1))
+			c.session.Terminate()
+
+			Eventually(result).Should(Receive(Equal(ErrNotConnected)))
+		})
+	})
+})
@@ -11,11 +11,96 @@ type handlerFunc = func(client *Client, args []string) error
 
 // Handlers for all instruction opcodes receivable by this Guacamole client.
 var handlers = map[string]handlerFunc{
+	reconnectedOpcode: func(c *Client, args []string) error {
+		c.logger.Debugf("Discarding display, streams and objects from previous connection")
+		c.display.reset()
+		c.streams.reset()
+		c.objects.reset()
+		return nil
+	},
+
+	"ack": func(c *Client, args []string) error {
+		c.streams.acknowledge(parseInt(args[0]), args[1], StatusCode(parseInt(args[2])))
+		return nil
+	},
+
+	"arc": func(c *Client, args []string) error {
+		layerIdx := parseInt(args[0])
+		x := parseFloat(args[1])
+		y := parseFloat(args[2])
+		radius := parseFloat(args[3])
+		start := parseFloat(args[4])
+		end := parseFloat(args[5])
+		negative := args[6] != "0"
+		c.display.arc(layerIdx, x, y, radius, start, end, negative)
+		return nil
+	},
+
+	"audio": func(c *Client, args []string) error {
+		idx := parseInt(args[0])
+		mimetype := args[1]
+		if c.onAudio == nil {
+			c.logger.Debugf("Refusing audio stream %d, as there is no OnAudio handler", idx)
+			return c.streams.sendAck(idx, "Audio unsupported", StatusUnsupported)
+		}
+		format, err := parseAudioFormat(mimetype)
+		if err != nil {
+			c.logger.Warnf("Refusing audio stream %d: %s", idx, err)
+			return c.streams.sendAck(idx, "Unsupported audio format", StatusClientBadType)
+		}
+		d := &audioDecoder{client: c, idx: idx, format: format}
+		c.streams.get(idx).onBlob = d.receive
+		return nil
+	},
+
 	"blob": func(c *Client, args []string) error {
 		idx := parseInt(args[0])
 		return c.streams.append(idx, args[1])
 	},
 
+	"body": func(c *Client, args []string) error {
+		objectIdx := parseInt(args[0])
+		idx := parseInt(args[1])
+		mimetype := args[2]
+		name := args[3]
+		d := newDownload(c, idx)
+		req := objectRequest{object: objectIdx, name: name}
+		if !c.objects.deliver(req, &objectBody{mimetype: mimetype, reader: d.reader}) {
+			c.logger.Warnf("Refusing unexpected contents of '%s' from object %d", name, objectIdx)
+			d.end(nil)
+			return c.streams.sendAck(idx, "Unexpected stream", StatusClientBadRequest)
+		}
+		d.listen(c.streams.get(idx))
+		return d.accept()
+	},
+
+	"clipboard": func(c *Client, args []string) error {
+		s := c.streams.get(parseInt(args[0]))
+		s.ack = true
+		mimetype := args[1]
+		s.onEnd = func(s *stream) {
+			data, err := s.data()
+			if err != nil {
+				c.logger.Errorf("Invalid clipboard data received: %s", err)
+				return
+			}
+			if c.onClipboard != nil {
+				c.onClipboard(mimetype, data)
+			}
+		}
+		return nil
+	},
+
+	"clip": func(c *Client, args []string) error {
+		c.display.clip(parseInt(args[0]))
+		return nil
+	},
+
+	"close": func(c *Client, args []string) error {
+		c.display.closePath(parseInt(args[0]))
+		return nil
+	},
+
 	"copy": func(c *Client, args []string) error {
 		srcL := parseInt(args[0])
 		srcX := parseInt(args[1])
@@ -42,6 +127,20 @@ var handlers = map[string]handlerFunc{
 		return nil
 	},
 
+	"cstroke": func(c *Client, args []string) error {
+		mask := parseInt(args[0])
+		layerIdx := parseInt(args[1])
+		lineCap := parseInt(args[2])
+		lineJoin := parseInt(args[3])
+		thickness := parseFloat(args[4])
+		r := parseInt(args[5])
+		g := parseInt(args[6])
+		b := parseInt(args[7])
+		a := parseInt(args[8])
+		c.display.stroke(layerIdx, lineCap, lineJoin, thickness, byte(r), byte(g), byte(b), byte(a), byte(mask))
+		return nil
+	},
+
 	"cursor": func(c *Client, args []string) error {
 		cursorHotspotX := parseInt(args[0])
 		cursorHotspotY := parseInt(args[1])
@@ -55,6 +154,18 @@ var handlers = map[string]handlerFunc{
 		return nil
 	},
 
+	"curve": func(c *Client, args []string) error {
+		layerIdx := parseInt(args[0])
+		cp1x := parseFloat(args[1])
+		cp1y := parseFloat(args[2])
+		cp2x := parseFloat(args[3])
+		cp2y := parseFloat(args[4])
+		x := parseFloat(args[5])
+		y := parseFloat(args[6])
+		c.display.curve(layerIdx, cp1x, cp1y, cp2x, cp2y, x, y)
+		return nil
+	},
+
 	"disconnect": func(c *Client, args []string) error {
 		c.session.Terminate()
 		return nil
@@ -74,7 +185,44 @@ var handlers = map[string]handlerFunc{
 	},
 
 	"error": func(c *Client, args []string) error {
-		c.logger.Warnf("Received error from server: (%s) - %s", args[1], args[0])
+		err := newServerError(args)
+		c.logger.Warnf("Received error from server: (%s) - %s", err.Status, err.Message)
+		if c.onError != nil {
+			c.onError(err)
+		}
+		c.session.terminate(err)
+		return nil
+	},
+
+	"file": func(c *Client, args []string) error {
+		idx := parseInt(args[0])
+		mimetype := args[1]
+		name := args[2]
+		if c.onFile == nil {
+			c.logger.Warnf("Refusing file '%s', as there is no OnFile handler", name)
+			return c.streams.sendAck(idx, "File transfer unsupported", StatusUnsupported)
+		}
+		d := newDownload(c, idx)
+		d.listen(c.streams.get(idx))
+		go func() {
+			defer d.abort()
+			c.onFile(name, mimetype, d.reader)
+		}()
+		return d.accept()
+	},
+
+	"filesystem": func(c *Client, args []string) error {
+		o := &Object{client: c, index: parseInt(args[0]), Name: args[1]}
+		c.logger.Infof("Filesystem '%s' available", o.Name)
+		c.objects.define(o)
+		if c.onFilesystem != nil {
+			c.onFilesystem(o)
+		}
+		return nil
+	},
+
+	"identity": func(c *Client, args []string) error {
+		c.display.identity(parseInt(args[0]))
 		return nil
 	},
 
@@ -91,11 +239,118 @@ var handlers = map[string]handlerFunc{
 		return nil
 	},
 
+	"lfill": func(c *Client, args []string) error {
+		mask := parseInt(args[0])
+		layerIdx := parseInt(args[1])
+		srcL := parseInt(args[2])
+		c.display.fillLayer(layerIdx, srcL, byte(mask))
+		return nil
+	},
+
+	"line": func(c *Client, args []string) error {
+		layerIdx := parseInt(args[0])
+		x := parseFloat(args[1])
+		y := parseFloat(args[2])
+		c.display.line(layerIdx, x, y)
+		return nil
+	},
+
 	"log": func(c *Client, args []string) error {
 		c.logger.Infof("Log from server:  %s", args[0])
 		return nil
 	},
 
+	"lstroke": func(c *Client, args []string) error {
+		mask := parseInt(args[0])
+		layerIdx := parseInt(args[1])
+		lineCap := parseInt(args[2])
+		lineJoin := parseInt(args[3])
+		thickness := parseFloat(args[4])
+		srcL := parseInt(args[5])
+		c.display.strokeLayer(layerIdx, lineCap, lineJoin, thickness, srcL, byte(mask))
+		return nil
+	},
+
+	"move": func(c *Client, args []string) error {
+		layerIdx := parseInt(args[0])
+		parentIdx := parseInt(args[1])
+		x := parseInt(args[2])
+		y := parseInt(args[3])
+		z := parseInt(args[4])
+		c.display.move(layerIdx, parentIdx, x, y, z)
+		return nil
+	},
+
+	"pipe": func(c *Client, args []string) error {
+		idx := parseInt(args[0])
+		mimetype := args[1]
+		name := args[2]
+		if c.onPipe == nil {
+			c.logger.Warnf("Refusing pipe '%s', as there is no OnPipe handler", name)
+			return c.streams.sendAck(idx, "Pipes unsupported", StatusUnsupported)
+		}
+		d := newDownload(c, idx)
+		d.listen(c.streams.get(idx))
+		go func() {
+			defer d.abort()
+			c.onPipe(name, mimetype, d.reader)
+		}()
+		return d.accept()
+	},
+
+	"pop": func(c *Client, args []string) error {
+		c.display.pop(parseInt(args[0]))
+		return nil
+	},
+
+	"push": func(c *Client, args []string) error {
+		c.display.push(parseInt(args[0]))
+		return nil
+	},
+
+	"required": func(c *Client, args []string) error {
+		if version := c.session.getVersion(); !version.AtLeast(protocol.Version130) {
+			c.logger.Warnf("Ignoring parameters %v required by a server using %s", args, version)
+			return nil
+		}
+		if c.onRequired == nil {
+			c.logger.Warnf("Server requires parameters %v, but there is no OnRequired handler", args)
+			return nil
+		}
+		values := c.onRequired(args)
+		for _, name := range args {
+			value, ok := values[name]
+			if !ok {
+				continue
+			}
+			if err := c.sendArgument(name, value); err != nil {
+				c.logger.Errorf("Failed to send parameter '%s': %s", name, err)
+				return err
+			}
+		}
+		return nil
+	},
+
+	"reset": func(c *Client, args []string) error {
+		c.display.resetLayer(parseInt(args[0]))
+		return nil
+	},
+
+	"set": func(c *Client, args []string) error {
+		layerIdx := parseInt(args[0])
+		property := args[1]
+		value := parseFloat(args[2])
+		c.display.set(layerIdx, property, value)
+		return nil
+	},
+
+	"shade": func(c *Client, args []string) error {
+		layerIdx := parseInt(args[0])
+		opacity := parseInt(args[1])
+		c.display.shade(layerIdx, byte(opacity))
+		return nil
+	},
+
 	"rect": func(c *Client, args []string) error {
 		layerIdx := parseInt(args[0])
 		x := parseInt(args[1])
@@ -114,6 +369,14 @@ var handlers = map[string]handlerFunc{
 		return nil
 	},
 
+	"start": func(c *Client, args []string) error {
+		layerIdx := parseInt(args[0])
+		x := parseFloat(args[1])
+		y := parseFloat(args[2])
+		c.display.start(layerIdx, x, y)
+		return nil
+	},
+
 	"sync": func(c *Client, args []string) error {
 		c.display.flush()
 		if err := c.session.Send(protocol.NewInstruction("sync", args...)); err != nil {
@@ -126,9 +389,55 @@ var handlers = map[string]handlerFunc{
 		}
 		return nil
 	},
+
+	"transform": func(c *Client, args []string) error {
+		layerIdx := parseInt(args[0])
+		xx := parseFloat(args[1])
+		yx := parseFloat(args[2])
+		xy := parseFloat(args[3])
+		yy := parseFloat(args[4])
+		x0 := parseFloat(args[5])
+		y0 := parseFloat(args[6])
+		c.display.transform(layerIdx, xx, yx, xy, yy, x0, y0)
+		return nil
+	},
+
+	"undefine": func(c *Client, args []string) error {
+		idx := parseInt(args[0])
+		if o, ok := c.objects.get(idx); ok {
+			c.logger.Infof("Filesystem '%s' removed", o.Name)
+		}
+		c.objects.undefine(idx)
+		return nil
+	},
+
+	"video": func(c *Client, args []string) error {
+		idx := parseInt(args[0])
+		layerIdx := parseInt(args[1])
+		mimetype := args[2]
+		if c.videoDecoder == nil {
+			return c.streams.sendAck(idx, "Video unsupported", StatusUnsupported)
+		}
+		decoder, err := c.videoDecoder.NewStream(mimetype)
+		if err != nil {
+			c.logger.Warnf("Refusing video stream %d (%s): %s", idx, mimetype, err)
+			return c.streams.sendAck(idx, "Unsupported video format", StatusClientBadType)
+		}
+		v := &videoStream{client: c, idx: idx, layerIdx: layerIdx, decoder: decoder}
+		s := c.streams.get(idx)
+		s.onBlob = v.receive
+		s.onEnd = v.end
+		s.onDiscard = v.discard
+		return nil
+	},
 }
 
 func parseInt(s string) int {
 	n, _ := strconv.Atoi(s)
 	return n
 }
+
+func parseFloat(s string) float64 {
+	n, _ := strconv.ParseFloat(s, 64)
+	return n
+}
@@ -2,23 +2,85 @@ package bring
 
 import (
 	"image"
+	"image/color"
 	"image/draw"
+	"math"
+	"sort"
 
 	"github.com/tfriedel6/canvas"
 	"github.com/tfriedel6/canvas/backend/softwarebackend"
 )
 
+// Default miter limit of lines, the same used by HTML canvases
+const defaultMiterLimit = 10.0
+
+// Line caps and joins, as identified in the "cstroke" and "lstroke" instructions
+const (
+	capButt = iota
+	capRound
+	capSquare
+)
+
+const (
+	joinBevel = iota
+	joinMiter
+	joinRound
+)
+
+// channelMask is the composite operation of drawing instructions. Each bit enables a part of the result:
+// 0x8 is the source where the destination is transparent, 0x4 the source where the destination is opaque,
+// 0x2 the destination where the source is transparent and 0x1 the destination where the source is opaque
+type channelMask byte
+
+// Porter-Duff operations, named as in libguac. The prefix R means the operation with the source and
+// destination reversed. The remaining masks are valid too, even if rarely used
+const (
+	compClear channelMask = 0x0
+	compRIn   channelMask = 0x1
+	compROut  channelMask = 0x2
+	compIn    channelMask = 0x4
+	compAtop  channelMask = 0x6
+	compOut   channelMask = 0x8
+	compRAtop channelMask = 0x9
+	compXor   channelMask = 0xA
+	compROver channelMask = 0xB
+	compSrc   channelMask = 0xC
+	compOver  channelMask = 0xE
+	compPlus  channelMask = 0xF
+)
+
 type layer struct {
 	width        int
 	height       int
 	image        *image.RGBA
 	gc           *canvas.Canvas
+	be           *softwarebackend.SoftwareBackend
 	visible      bool
 	modified     bool
 	modifiedRect image.Rectangle
 	pathOpen     bool
 	pathRect     image.Rectangle
 	autosize     bool
+
+	// Position in the layer hierarchy. Visible layers are displayed inside their parents, clipped by
+	// them, at the position (x, y) relative to the parent. Buffers have no parent
+	parent  *layer
+	x, y, z int
+	opacity uint8
+
+	// Drawing state, also kept by the canvas. It is tracked here to calculate the area modified by
+	// each operation, and it is saved and restored by push and pop
+	state  layerState
+	states []layerState
+
+	// Used to render paths filled or stroked with the contents of other layers
+	mask     *image.RGBA
+	maskRect image.Rectangle
+}
+
+type layerState struct {
+	transform  matrix
+	miterLimit float64
 }
 
 func (l *layer) updateModifiedRect(modArea image.Rectangle) {
@@ -33,9 +95,13 @@ func (l *layer) resetModified() {
 }
 
 func (l *layer) setupCanvas() {
-	be := softwarebackend.New(l.width, l.height)
-	be.Image = l.image
-	l.gc = canvas.New(be)
+	l.be = softwarebackend.New(l.width, l.height)
+	l.be.Image = l.image
+	l.gc = canvas.New(l.be)
+	// Keeps the initial state in the bottom of the stack, so it can be restored by reset
+	l.gc.Save()
+	l.state = layerState{transform: identityMatrix, miterLimit: defaultMiterLimit}
+	l.states = nil
 }
 
 func (l *layer) fitRect(x int, y int, w int, h int) {
@@ -44,13 +110,7 @@ func (l *layer) fitRect(x int, y int, w int, h int) {
 	l.Resize(final.Max.X, final.Max.Y)
 }
 
-func copyImage(dest draw.Image, x, y int, src image.Image, sr image.Rectangle, op draw.Op) {
-	dp := image.Pt(x, y)
-	dr := image.Rectangle{Min: dp, Max: dp.Add(sr.Size())}
-	draw.Draw(dest, dr, src, sr.Min, op)
-}
-
-func (l *layer) Copy(srcLayer *layer, srcx, srcy, srcw, srch, x, y int, op draw.Op) {
+func (l *layer) Copy(srcLayer *layer, srcx, srcy, srcw, srch, x, y int, op channelMask) {
 	srcImg := srcLayer.image
 	srcDim := srcImg.Bounds()
 
@@ -77,17 +137,17 @@ func (l *layer) Copy(srcLayer *layer, srcx, srcy, srcw, srch, x, y int, op draw.
 		l.fitRect(x, y, srcw, srch)
 	}
 
-	srcCopyDim := image.Rect(srcx, srcy, srcx+srcw, srcy+srch)
-	copyImage(l.image, x, y, srcImg, srcCopyDim, op)
-	l.updateModifiedRect(image.Rect(x, y, x+srcw, y+srch))
+	dr := image.Rect(x, y, x+srcw, y+srch)
+	composite(l.image, dr, srcLayer.image, image.Pt(srcx, srcy), nil, op)
+	l.updateModifiedRect(dr)
 }
 
-func (l *layer) Draw(x, y int, src image.Image, op draw.Op) {
+func (l *layer) Draw(x, y int, src image.Image, op channelMask) {
 	srcDim := src.Bounds()
 	if l.autosize {
 		l.fitRect(x, y, srcDim.Max.X, srcDim.Max.Y)
 	}
-	copyImage(l.image, x, y, src, srcDim, op)
+	composite(l.image, image.Rect(x, y, x+srcDim.Dx(), y+srcDim.Dy()), src, srcDim.Min, nil, op)
 	l.updateModifiedRect(image.Rect(x, y, x+srcDim.Max.X, y+srcDim.Max.Y))
 }
 
@@ -101,35 +161,430 @@ func (l *layer) Resize(w int, h int) {
 	l.image = newImage
 	l.width = w
 	l.height = h
-	l.setupCanvas()
+	// Keeps the canvas, with its current path and state. Only the clipping region is lost
+	l.be.SetSize(w, h)
+	l.be.Image = l.image
+	l.mask = nil
 	l.updateModifiedRect(original.Union(l.image.Bounds()))
 }
 
+// appendToPath adds the area of a path operation, in layer coordinates, to the area of the current path.
+// If the last path was already used (filled, stroked, clipped or closed), a new path is started
 func (l *layer) appendToPath(rect image.Rectangle) {
 	if !l.pathOpen {
 		l.gc.BeginPath()
 		l.pathOpen = true
 		l.pathRect = image.Rectangle{}
 	}
-	l.pathRect = l.pathRect.Union(rect)
+	l.pathRect = l.pathRect.Union(l.state.transform.transformRect(rect))
 }
 
-func (l *layer) endPath() {
-	l.updateModifiedRect(l.pathRect)
+// endPath marks the area of the current path, grown by pad pixels in all directions, as modified.
+// The path can still be used by other operations, until a new one is started
+func (l *layer) endPath(pad int) {
+	r := l.pathRect.Inset(-pad).Intersect(l.image.Bounds())
+	l.updateModifiedRect(r)
 	l.pathOpen = false
-	l.pathRect = image.Rectangle{}
+}
+
+// fitPoint grows autosize layers to contain the point
+func (l *layer) fitPoint(x, y float64) {
+	if l.autosize {
+		l.fitRect(0, 0, int(math.Ceil(x)), int(math.Ceil(y)))
+	}
 }
 
 func (l *layer) Rect(x int, y int, width int, height int) {
+	if l.autosize {
+		l.fitRect(x, y, width, height)
+	}
 	l.appendToPath(image.Rect(x, y, x+width, y+height))
 	l.gc.Rect(float64(x), float64(y), float64(width), float64(height))
 }
 
-func (l *layer) Fill(r byte, g byte, b byte, a byte, op draw.Op) {
-	// Ignores op, as the canvas library does not support it :/
-	l.gc.SetFillStyle(r, g, b, a)
-	l.gc.Fill()
-	l.endPath()
+// Start a new subpath at the point
+func (l *layer) Start(x, y float64) {
+	l.fitPoint(x, y)
+	l.appendToPath(pointRect(x, y, 0))
+	l.gc.MoveTo(x, y)
+}
+
+// Line adds a straight line from the current point to the point provided
+func (l *layer) Line(x, y float64) {
+	l.fitPoint(x, y)
+	l.appendToPath(pointRect(x, y, 0))
+	l.gc.LineTo(x, y)
+}
+
+// Curve adds a cubic Bézier curve from the current point to the point (x, y)
+func (l *layer) Curve(cp1x, cp1y, cp2x, cp2y, x, y float64) {
+	l.fitPoint(cp1x, cp1y)
+	l.fitPoint(cp2x, cp2y)
+	l.fitPoint(x, y)
+	// The curve is always inside the area delimited by its control points
+	l.appendToPath(pointRect(cp1x, cp1y, 0).Union(pointRect(cp2x, cp2y, 0)).Union(pointRect(x, y, 0)))
+	l.gc.BezierCurveTo(cp1x, cp1y, cp2x, cp2y, x, y)
+}
+
+// Arc adds an arc of the circle centered at (x, y), from the angle start to end, in radians
+func (l *layer) Arc(x, y, radius, start, end float64, negative bool) {
+	l.fitPoint(x+radius, y+radius)
+	l.appendToPath(pointRect(x, y, radius))
+	l.gc.Arc(x, y, radius, start, end, negative)
+}
+
+// Close the current subpath, connecting its last point to the first one
+func (l *layer) Close() {
+	l.gc.ClosePath()
+	l.pathOpen = false
+}
+
+// Fill the current path with the color provided
+func (l *layer) Fill(r, g, b, a byte, op channelMask) {
+	mask := l.renderFill()
+	composite(l.image, l.maskRect, solidColor(r, g, b, a), l.maskRect.Min, mask, op)
+	l.endPath(1)
+}
+
+// Stroke the current path with the color provided
+func (l *layer) Stroke(lineCap, lineJoin int, thickness float64, r, g, b, a byte, op channelMask) {
+	mask, pad := l.renderStroke(lineCap, lineJoin, thickness)
+	composite(l.image, l.maskRect, solidColor(r, g, b, a), l.maskRect.Min, mask, op)
+	l.endPath(pad)
+}
+
+// FillLayer fills the current path with the contents of the src layer, repeated as a pattern
+func (l *layer) FillLayer(src *layer, op channelMask) {
+	mask := l.renderFill()
+	l.drawPattern(src, mask, op)
+	l.endPath(1)
+}
+
+// StrokeLayer strokes the current path with the contents of the src layer, repeated as a pattern
+func (l *layer) StrokeLayer(lineCap, lineJoin int, thickness float64, src *layer, op channelMask) {
+	mask, pad := l.renderStroke(lineCap, lineJoin, thickness)
+	l.drawPattern(src, mask, op)
+	l.endPath(pad)
+}
+
+// renderFill renders the area covered by the current path in the mask
+func (l *layer) renderFill() *image.RGBA {
+	return l.renderMask(l.pathRect.Inset(-1), func() {
+		l.gc.SetFillStyle(color.White)
+		l.gc.Fill()
+	})
+}
+
+// renderStroke renders the area covered by the stroke of the current path in the mask, also returning
+// how far outside the path it can reach
+func (l *layer) renderStroke(lineCap, lineJoin int, thickness float64) (*image.RGBA, int) {
+	pad := l.strokePadding(lineJoin, thickness)
+	mask := l.renderMask(l.pathRect.Inset(-pad), func() {
+		l.setLineStyle(lineCap, lineJoin, thickness)
+		l.gc.SetStrokeStyle(color.White)
+		l.gc.Stroke()
+	})
+	return mask, pad
+}
+
+// Move the layer into parent, at the position (x, y) relative to it. Among the children of the same
+// parent, the ones with higher z are displayed above. It returns false if parent is the layer itself or
+// one of its children
+func (l *layer) Move(parent *layer, x, y, z int) bool {
+	for p := parent; p != nil; p = p.parent {
+		if p == l {
+			return false
+		}
+	}
+	l.parent = parent
+	l.x, l.y, l.z = x, y, z
+	return true
+}
+
+// Shade sets the opacity of the layer, which also applies to its children
+func (l *layer) Shade(opacity uint8) {
+	l.opacity = opacity
+}
+
+// Clip further drawing operations to the current path. The clipping region can only be reduced, and
+// it is restored by pop or reset
+func (l *layer) Clip() {
+	l.gc.Clip()
+	l.pathOpen = false
+}
+
+// Push saves the drawing state (transform, clipping region and line settings) in the stack
+func (l *layer) Push() {
+	l.gc.Save()
+	l.states = append(l.states, l.state)
+}
+
+// Pop restores the last drawing state saved by Push
+func (l *layer) Pop() {
+	if len(l.states) == 0 {
+		return
+	}
+	l.gc.Restore()
+	l.state = l.states[len(l.states)-1]
+	l.states = l.states[:len(l.states)-1]
+}
+
+// Reset clears the drawing state stack, restoring the initial state and starting a new path
+func (l *layer) Reset() {
+	for range l.states {
+		l.gc.Restore()
+	}
+	l.gc.Restore()
+	l.gc.Save()
+	l.states = nil
+	l.state = layerState{transform: identityMatrix, miterLimit: defaultMiterLimit}
+	l.gc.BeginPath()
+	l.pathOpen = false
+}
+
+// Set a property of the layer. Only "miter-limit" is defined by the protocol
+func (l *layer) Set(property string, value float64) bool {
+	if property != "miter-limit" {
+		return false
+	}
+	l.state.miterLimit = value
+	l.gc.SetMiterLimit(value)
+	return true
+}
+
+// Identity resets the transform applied to further drawing operations
+func (l *layer) Identity() {
+	l.state.transform = identityMatrix
+	l.gc.SetTransform(1, 0, 0, 1, 0, 0)
+}
+
+// Transform multiplies the current transform by the matrix provided
+func (l *layer) Transform(a, b, c, d, e, f float64) {
+	l.state.transform = matrix{a, b, c, d, e, f}.then(l.state.transform)
+	l.gc.Transform(a, b, c, d, e, f)
+}
+
+func (l *layer) setLineStyle(lineCap, lineJoin int, thickness float64) {
+	switch lineCap {
+	case capButt:
+		l.gc.SetLineCap(canvas.Butt)
+	case capRound:
+		l.gc.SetLineCap(canvas.Round)
+	case capSquare:
+		l.gc.SetLineCap(canvas.Square)
+	}
+	switch lineJoin {
+	case joinBevel:
+		l.gc.SetLineJoin(canvas.Bevel)
+	case joinMiter:
+		l.gc.SetLineJoin(canvas.Miter)
+	case joinRound:
+		l.gc.SetLineJoin(canvas.Round)
+	}
+	l.gc.SetLineWidth(thickness)
+}
+
+// strokePadding returns how far outside the path a stroke can reach, in pixels
+func (l *layer) strokePadding(lineJoin int, thickness float64) int {
+	extent := math.Sqrt2 // Square caps
+	if lineJoin == joinMiter && l.state.miterLimit > extent {
+		extent = l.state.miterLimit
+	}
+	return int(math.Ceil(thickness/2*extent*l.state.transform.scale())) + 1
+}
+
+// renderMask draws on the mask, instead of the layer, using paint, and returns the mask. Only the
+// area r is cleared before painting, so paint must not draw outside it
+func (l *layer) renderMask(r image.Rectangle, paint func()) *image.RGBA {
+	if l.mask == nil {
+		l.mask = image.NewRGBA(l.image.Bounds())
+	} else {
+		draw.Draw(l.mask, l.maskRect, image.Transparent, image.Point{}, draw.Src)
+	}
+	l.maskRect = r.Intersect(l.mask.Bounds())
+	l.be.Image = l.mask
+	paint()
+	l.be.Image = l.image
+	return l.mask
+}
+
+// drawPattern draws the src layer, repeated as a pattern, through the mask
+func (l *layer) drawPattern(src *layer, mask *image.RGBA, op channelMask) {
+	if src.width == 0 || src.height == 0 {
+		return
+	}
+	composite(l.image, l.maskRect, &pattern{src.image}, l.maskRect.Min, mask, op)
+}
+
+// solidColor returns an image with the color provided, which is not premultiplied by alpha
+func solidColor(r, g, b, a byte) *image.Uniform {
+	return image.NewUniform(color.NRGBA{R: r, G: g, B: b, A: a})
+}
+
+// composite draws src on the area r of dst, aligning sp with r.Min, using the Porter-Duff operation
+// defined by the channel mask. Only the area r is affected, even by operations that would clear the
+// destination where the source is transparent. If mask is not nil, its alpha is the coverage of each
+// pixel of dst: the result is blended with the original destination by it, so pixels not covered
+// are not changed
+func composite(dst *image.RGBA, r image.Rectangle, src image.Image, sp image.Point, mask *image.RGBA, op channelMask) {
+	// The standard library implements the most common operations with the same results, but faster.
+	// DrawMask is not used with Src, as it also replaces the pixels not covered by the mask
+	switch {
+	case op == compOver:
+		draw.DrawMask(dst, r, src, sp, maskOrNil(mask), r.Min, draw.Over)
+		return
+	case op == compSrc && mask == nil:
+		draw.Draw(dst, r, src, sp, draw.Src)
+		return
+	case op == compROut|compRIn:
+		// The destination is kept as is
+		return
+	}
+
+	delta := r.Min.Sub(sp)
+	r = r.Intersect(dst.Bounds()).Intersect(src.Bounds().Add(delta))
+	if mask != nil {
+		r = r.Intersect(mask.Bounds())
+	}
+	if r.Empty() {
+		return
+	}
+	if srcImg, ok := src.(*image.RGBA); ok && srcImg == dst {
+		// Reads the source from a copy, as it is modified while drawing
+		sr := r.Sub(delta)
+		clone := image.NewRGBA(sr)
+		draw.Draw(clone, sr, srcImg, sr.Min, draw.Src)
+		src = clone
+	}
+
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			coverage := uint32(0xff)
+			if mask != nil {
+				coverage = uint32(mask.Pix[mask.PixOffset(x, y)+3])
+				if coverage == 0 {
+					continue
+				}
+			}
+			sr, sg, sb, sa := premultipliedAt(src, x-delta.X, y-delta.Y)
+			i := dst.PixOffset(x, y)
+			d := dst.Pix[i : i+4 : i+4]
+			da := uint32(d[3])
+
+			var fa, fb uint32
+			if op&0x8 != 0 {
+				fa += 0xff - da
+			}
+			if op&0x4 != 0 {
+				fa += da
+			}
+			if op&0x2 != 0 {
+				fb += 0xff - sa
+			}
+			if op&0x1 != 0 {
+				fb += sa
+			}
+			for c, sc := range [4]uint32{sr, sg, sb, sa} {
+				dc := uint32(d[c])
+				v := (fa*sc + fb*dc + 0x7f) / 0xff
+				if v > 0xff {
+					v = 0xff
+				}
+				d[c] = uint8((coverage*v + (0xff-coverage)*dc + 0x7f) / 0xff)
+			}
+		}
+	}
+}
+
+// maskOrNil avoids passing a typed nil pointer as a non-nil image.Image to the draw package
+func maskOrNil(mask *image.RGBA) image.Image {
+	if mask == nil {
+		return nil
+	}
+	return mask
+}
+
+// premultipliedAt returns the color of the pixel of img, premultiplied by alpha, with 8 bits per channel
+func premultipliedAt(img image.Image, x, y int) (r, g, b, a uint32) {
+	if rgba, ok := img.(*image.RGBA); ok {
+		i := rgba.PixOffset(x, y)
+		p := rgba.Pix[i : i+4 : i+4]
+		return uint32(p[0]), uint32(p[1]), uint32(p[2]), uint32(p[3])
+	}
+	r, g, b, a = img.At(x, y).RGBA()
+	return r >> 8, g >> 8, b >> 8, a >> 8
+}
+
+// pattern is an infinite image, repeating the contents of another one
+type pattern struct {
+	image *image.RGBA
+}
+
+func (p *pattern) ColorModel() color.Model { return p.image.ColorModel() }
+
+func (p *pattern) Bounds() image.Rectangle {
+	return image.Rect(math.MinInt32, math.MinInt32, math.MaxInt32, math.MaxInt32)
+}
+
+func (p *pattern) At(x, y int) color.Color {
+	b := p.image.Bounds()
+	x, y = (x-b.Min.X)%b.Dx(), (y-b.Min.Y)%b.Dy()
+	if x < 0 {
+		x += b.Dx()
+	}
+	if y < 0 {
+		y += b.Dy()
+	}
+	return p.image.At(b.Min.X+x, b.Min.Y+y)
+}
+
+// pointRect returns the smallest rectangle containing all pixels touched by the circle centered at (x, y)
+// with the radius provided. For points (zero radius), it contains the pixel of the point
+func pointRect(x, y, radius float64) image.Rectangle {
+	return image.Rect(int(math.Floor(x-radius)), int(math.Floor(y-radius)),
+		int(math.Floor(x+radius))+1, int(math.Floor(y+radius))+1)
+}
+
+// matrix is an affine transform, in the same format used by the "transform" instruction:
+// x' = a*x + c*y + e and y' = b*x + d*y + f
+type matrix [6]float64
+
+var identityMatrix = matrix{1, 0, 0, 1, 0, 0}
+
+// then returns the transform that applies m and then n
+func (m matrix) then(n matrix) matrix {
+	return matrix{
+		n[0]*m[0] + n[2]*m[1],
+		n[1]*m[0] + n[3]*m[1],
+		n[0]*m[2] + n[2]*m[3],
+		n[1]*m[2] + n[3]*m[3],
+		n[0]*m[4] + n[2]*m[5] + n[4],
+		n[1]*m[4] + n[3]*m[5] + n[5],
+	}
+}
+
+func (m matrix) apply(x, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+// scale returns the largest factor the transform can scale a distance by
+func (m matrix) scale() float64 {
+	return math.Max(math.Hypot(m[0], m[1]), math.Hypot(m[2], m[3]))
+}
+
+// transformRect returns the bounding box of the rectangle after the transform is applied
+func (m matrix) transformRect(r image.Rectangle) image.Rectangle {
+	if m == identityMatrix {
+		return r
+	}
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, p := range []image.Point{r.Min, {r.Max.X, r.Min.Y}, {r.Min.X, r.Max.Y}, r.Max} {
+		x, y := m.apply(float64(p.X), float64(p.Y))
+		minX, minY = math.Min(minX, x), math.Min(minY, y)
+		maxX, maxY = math.Max(maxX, x), math.Max(maxY, y)
+	}
+	return image.Rect(int(math.Floor(minX)), int(math.Floor(minY)), int(math.Ceil(maxX)), int(math.Ceil(maxY)))
 }
 
 type layers map[int]*layer
@@ -145,6 +600,7 @@ func newBuffer() *layer {
 	l := &layer{
 		image:    image.NewRGBA(image.Rect(0, 0, 0, 0)),
 		autosize: true,
+		opacity:  0xff,
 	}
 	l.setupCanvas()
 	return l
@@ -156,6 +612,8 @@ func newVisibleLayer(l0 *layer) *layer {
 		height:  l0.height,
 		image:   image.NewRGBA(image.Rect(0, 0, l0.width, l0.height)),
 		visible: true,
+		parent:  l0,
+		opacity: 0xff,
 	}
 	l.setupCanvas()
 	return l
@@ -177,12 +635,48 @@ func (ls layers) get(id int) *layer {
 	return ls[id]
 }
 
+// delete the layer. Its children are detached, and are not displayed until moved to another parent
 func (ls layers) delete(id int) {
-	if id == 0 {
+	l, ok := ls[id]
+	if id == 0 || !ok {
 		return
 	}
-	ls[0].updateModifiedRect(ls[id].image.Bounds())
-	ls[id].image = nil
-	ls[id] = nil
+	for _, child := range ls.children(l) {
+		child.parent = nil
+	}
+	l.image = nil
 	delete(ls, id)
 }
+
+// children returns the layers inside l, from the bottom to the top one
+func (ls layers) children(l *layer) []*layer {
+	var ids []int
+	for id, child := range ls {
+		if child.parent == l {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ls[ids[i]].z != ls[ids[j]].z {
+			return ls[ids[i]].z < ls[ids[j]].z
+		}
+		return ids[i] < ids[j]
+	})
+	children := make([]*layer, len(ids))
+	for i, id := range ids {
+		children[i] = ls[id]
+	}
+	return children
+}
+
+// toScreen converts the area r of the layer to screen coordinates, clipping it by all its parents. It
+// returns false if the layer is not displayed, as it is a buffer or it was detached from the hierarchy
+func (ls layers) toScreen(l *layer, r image.Rectangle) (image.Rectangle, bool) {
+	for ; l != ls[0]; l = l.parent {
+		if l.parent == nil {
+			return image.Rectangle{}, false
+		}
+		r = r.Add(image.Pt(l.x, l.y)).Intersect(l.parent.image.Bounds())
+	}
+	return r, true
+}
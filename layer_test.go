@@ -1,7 +1,10 @@
 package bring
 
 import (
+	"image"
+	"image/color"
 	"image/draw"
+	"math"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -50,6 +53,59 @@ var _ = Describe("Layers", func() {
 		layers.delete(0)
 		Expect(layers[0]).To(Equal(l))
 	})
+
+	Describe("Hierarchy", func() {
+		It("creates visible layers inside the default layer", func() {
+			l := layers.get(1)
+			Expect(l.parent).To(BeIdenticalTo(layers.getDefault()))
+			Expect(l.opacity).To(Equal(uint8(0xff)))
+			Expect(layers.get(-1).parent).To(BeNil())
+		})
+
+		It("lists children ordered by z, and then by index", func() {
+			l0 := layers.getDefault()
+			l1, l2, l3 := layers.get(1), layers.get(2), layers.get(3)
+			Expect(l1.Move(l0, 0, 0, 5)).To(BeTrue())
+			Expect(l2.Move(l0, 0, 0, 1)).To(BeTrue())
+			Expect(l3.Move(l0, 0, 0, 1)).To(BeTrue())
+			children := layers.children(l0)
+			Expect(children).To(HaveLen(3))
+			Expect(children[0]).To(BeIdenticalTo(l2))
+			Expect(children[1]).To(BeIdenticalTo(l3))
+			Expect(children[2]).To(BeIdenticalTo(l1))
+		})
+
+		It("refuses moving a layer inside itself", func() {
+			l1, l2 := layers.get(1), layers.get(2)
+			Expect(l2.Move(l1, 0, 0, 0)).To(BeTrue())
+			Expect(l1.Move(l2, 0, 0, 0)).To(BeFalse())
+			Expect(l1.Move(l1, 0, 0, 0)).To(BeFalse())
+			Expect(l1.parent).To(BeIdenticalTo(layers.getDefault()))
+		})
+
+		It("converts areas to screen coordinates, clipped by the parents", func() {
+			l1, l2 := layers.get(1), layers.get(2)
+			l1.Resize(100, 100)
+			l1.Move(layers.getDefault(), 10, 20, 0)
+			l2.Move(l1, 50, 50, 0)
+
+			r, ok := layers.toScreen(l2, image.Rect(0, 0, 80, 10))
+			Expect(ok).To(BeTrue())
+			Expect(r).To(Equal(image.Rect(60, 70, 110, 80)))
+
+			_, ok = layers.toScreen(layers.get(-1), image.Rect(0, 0, 10, 10))
+			Expect(ok).To(BeFalse())
+		})
+
+		It("detaches the children of deleted layers", func() {
+			l1, l2 := layers.get(1), layers.get(2)
+			l2.Move(l1, 0, 0, 0)
+			layers.delete(1)
+			Expect(l2.parent).To(BeNil())
+			_, ok := layers.toScreen(l2, l2.image.Bounds())
+			Expect(ok).To(BeFalse())
+		})
+	})
 })
 
 var _ = Describe("Layer", func() {
@@ -88,21 +144,289 @@ var _ = Describe("Layer", func() {
 
 	Describe("Copy", func() {
 		It("grows the buffer to fit a larger source", func() {
-			dst.Copy(src, 0, 0, 100, 100, 0, 0, draw.Src)
+			dst.Copy(src, 0, 0, 100, 100, 0, 0, compSrc)
 			Expect(dst.width).To(Equal(100))
 			Expect(dst.height).To(Equal(100))
 		})
 
 		It("clips the source canvas if copying a larger rectangle from source", func() {
-			dst.Copy(src, 0, 0, 200, 200, 0, 0, draw.Src)
+			dst.Copy(src, 0, 0, 200, 200, 0, 0, compSrc)
 			Expect(dst.width).To(Equal(100))
 			Expect(dst.height).To(Equal(100))
 		})
 
 		It("does not copy anything if rectangle is outside of the src canvas", func() {
-			dst.Copy(src, 120, 120, 10, 10, 0, 0, draw.Src)
+			dst.Copy(src, 120, 120, 10, 10, 0, 0, compSrc)
 			Expect(dst.width).To(BeZero())
 			Expect(dst.height).To(BeZero())
 		})
 	})
+
+	Describe("Paths", func() {
+		var l *layer
+		red := color.RGBA{255, 0, 0, 255}
+		transparent := color.RGBA{}
+
+		BeforeEach(func() {
+			l = layers.get(1)
+			l.resetModified()
+		})
+
+		It("strokes lines, marking the stroke area as modified", func() {
+			l.Start(10, 50)
+			l.Line(90, 50)
+			l.Stroke(capButt, joinMiter, 10, 255, 0, 0, 255, compOver)
+
+			Expect(l.image.At(50, 52)).To(Equal(red))
+			Expect(l.image.At(50, 60)).To(Equal(transparent))
+			Expect(l.modifiedRect.Min.X).To(BeNumerically("<=", 10))
+			Expect(l.modifiedRect.Max.X).To(BeNumerically(">=", 90))
+			Expect(l.modifiedRect.Min.Y).To(BeNumerically("<=", 45))
+			Expect(l.modifiedRect.Max.Y).To(BeNumerically(">=", 55))
+		})
+
+		It("fills arcs", func() {
+			l.Arc(50, 50, 20, 0, 2*math.Pi, false)
+			l.Fill(255, 0, 0, 255, compOver)
+
+			Expect(l.image.At(50, 50)).To(Equal(red))
+			Expect(l.image.At(50, 35)).To(Equal(red))
+			Expect(l.image.At(33, 33)).To(Equal(transparent))
+			Expect(l.modifiedRect).To(Equal(image.Rect(29, 29, 72, 72)))
+		})
+
+		It("fills curves", func() {
+			l.Start(10, 90)
+			l.Curve(10, 10, 90, 10, 90, 90)
+			l.Close()
+			l.Fill(255, 0, 0, 255, compOver)
+
+			Expect(l.image.At(50, 50)).To(Equal(red))
+			Expect(l.image.At(50, 15)).To(Equal(transparent))
+			Expect(l.modifiedRect).To(Equal(image.Rect(9, 9, 92, 92)))
+		})
+
+		It("reuses the path for filling and stroking", func() {
+			l.Rect(20, 20, 60, 60)
+			l.Fill(0, 0, 255, 255, compOver)
+			l.Stroke(capButt, joinMiter, 4, 255, 0, 0, 255, compOver)
+
+			Expect(l.image.At(50, 50)).To(Equal(color.RGBA{0, 0, 255, 255}))
+			Expect(l.image.At(20, 50)).To(Equal(red))
+		})
+
+		It("starts a new path after the previous one is used", func() {
+			l.Rect(0, 0, 10, 10)
+			l.Fill(0, 0, 255, 255, compOver)
+			l.Rect(50, 50, 10, 10)
+			l.Fill(255, 0, 0, 255, compOver)
+
+			Expect(l.image.At(5, 5)).To(Equal(color.RGBA{0, 0, 255, 255}))
+			Expect(l.image.At(55, 55)).To(Equal(red))
+		})
+
+		It("applies transforms to the path", func() {
+			l.Transform(1, 0, 0, 1, 100, 0)
+			l.Transform(2, 0, 0, 2, 0, 0)
+			l.Rect(0, 0, 10, 10)
+			l.Fill(255, 0, 0, 255, compOver)
+
+			Expect(l.image.At(5, 5)).To(Equal(transparent))
+			Expect(l.image.At(115, 15)).To(Equal(red))
+			Expect(l.modifiedRect).To(Equal(image.Rect(99, -1, 121, 21).Intersect(l.image.Bounds())))
+		})
+
+		It("saves and restores the drawing state", func() {
+			l.Push()
+			l.Transform(1, 0, 0, 1, 100, 0)
+			l.Pop()
+			l.Rect(0, 0, 10, 10)
+			l.Fill(255, 0, 0, 255, compOver)
+			Expect(l.image.At(5, 5)).To(Equal(red))
+
+			l.Push()
+			l.Transform(1, 0, 0, 1, 100, 0)
+			l.Push()
+			l.Reset()
+			Expect(l.states).To(BeEmpty())
+			l.Rect(20, 0, 10, 10)
+			l.Fill(255, 0, 0, 255, compOver)
+			Expect(l.image.At(25, 5)).To(Equal(red))
+
+			l.Transform(1, 0, 0, 1, 100, 0)
+			l.Identity()
+			l.Rect(40, 0, 10, 10)
+			l.Fill(255, 0, 0, 255, compOver)
+			Expect(l.image.At(45, 5)).To(Equal(red))
+		})
+
+		It("clips drawing to the path", func() {
+			l.Push()
+			l.Rect(0, 0, 50, 50)
+			l.Clip()
+			l.Rect(0, 0, 100, 100)
+			l.Fill(255, 0, 0, 255, compOver)
+			Expect(l.image.At(25, 25)).To(Equal(red))
+			Expect(l.image.At(75, 75)).To(Equal(transparent))
+
+			l.Pop()
+			l.Rect(0, 0, 100, 100)
+			l.Fill(255, 0, 0, 255, compOver)
+			Expect(l.image.At(75, 75)).To(Equal(red))
+		})
+
+		It("fills and strokes paths with the contents of another layer", func() {
+			src := newBuffer()
+			src.Resize(2, 1)
+			src.image.Set(0, 0, red)
+			src.image.Set(1, 0, color.RGBA{0, 0, 255, 255})
+
+			l.Rect(10, 10, 20, 20)
+			l.FillLayer(src, compOver)
+			Expect(l.image.At(14, 20)).To(Equal(red))
+			Expect(l.image.At(15, 20)).To(Equal(color.RGBA{0, 0, 255, 255}))
+			Expect(l.image.At(35, 20)).To(Equal(transparent))
+
+			l.Start(50, 50)
+			l.Line(90, 50)
+			l.StrokeLayer(capButt, joinMiter, 6, src, compOver)
+			Expect(l.image.At(60, 50)).To(Equal(red))
+			Expect(l.image.At(61, 50)).To(Equal(color.RGBA{0, 0, 255, 255}))
+			Expect(l.image.At(60, 40)).To(Equal(transparent))
+		})
+
+		It("sets the miter limit", func() {
+			Expect(l.Set("miter-limit", 4)).To(BeTrue())
+			Expect(l.state.miterLimit).To(Equal(4.0))
+			Expect(l.Set("unknown", 4)).To(BeFalse())
+		})
+
+		It("grows buffers to fit the path", func() {
+			b := newBuffer()
+			b.Start(10, 10)
+			b.Line(40, 30)
+			Expect(b.width).To(Equal(40))
+			Expect(b.height).To(Equal(30))
+			b.Stroke(capButt, joinMiter, 2, 255, 0, 0, 255, compOver)
+			Expect(b.image.At(25, 20)).ToNot(Equal(transparent))
+		})
+	})
+
+	Describe("Compositing", func() {
+		// Reference results of all channel masks, for the source and destination pixels below
+		src := color.RGBA{102, 0, 0, 102}
+		dst := color.RGBA{0, 0, 153, 204}
+		expected := map[channelMask]color.RGBA{
+			compClear: {0, 0, 0, 0},
+			compRIn:   {0, 0, 61, 82},
+			compROut:  {0, 0, 92, 122},
+			0x3:       {0, 0, 153, 204},
+			compIn:    {82, 0, 0, 82},
+			0x5:       {82, 0, 61, 163},
+			compAtop:  {82, 0, 92, 204},
+			0x7:       {82, 0, 153, 255},
+			compOut:   {20, 0, 0, 20},
+			compRAtop: {20, 0, 61, 102},
+			compXor:   {20, 0, 92, 143},
+			compROver: {20, 0, 153, 224},
+			compSrc:   {102, 0, 0, 102},
+			0xD:       {102, 0, 61, 184},
+			compOver:  {102, 0, 92, 224},
+			compPlus:  {102, 0, 153, 255},
+		}
+
+		// The standard library, used for some operations, can round results differently
+		closeTo := func(expected color.RGBA) OmegaMatcher {
+			return SatisfyAll(
+				WithTransform(func(c color.RGBA) uint8 { return c.R }, BeNumerically("~", expected.R, 1)),
+				WithTransform(func(c color.RGBA) uint8 { return c.G }, BeNumerically("~", expected.G, 1)),
+				WithTransform(func(c color.RGBA) uint8 { return c.B }, BeNumerically("~", expected.B, 1)),
+				WithTransform(func(c color.RGBA) uint8 { return c.A }, BeNumerically("~", expected.A, 1)),
+			)
+		}
+
+		var l, s *layer
+		BeforeEach(func() {
+			l = layers.get(1)
+			s = newBuffer()
+			s.Resize(4, 4)
+			draw.Draw(s.image, s.image.Bounds(), image.NewUniform(src), image.Point{}, draw.Src)
+		})
+
+		// prepare fills the destination, also marking a pixel outside the area drawn by the operations
+		prepare := func() {
+			draw.Draw(l.image, l.image.Bounds(), image.Transparent, image.Point{}, draw.Src)
+			draw.Draw(l.image, image.Rect(0, 0, 30, 30), image.NewUniform(dst), image.Point{}, draw.Src)
+		}
+
+		It("copies layers with all channel masks", func() {
+			for op, result := range expected {
+				prepare()
+				l.Copy(s, 0, 0, 4, 4, 10, 10, op)
+				Expect(l.image.At(12, 12)).To(closeTo(result), "channel mask 0x%X", int(op))
+				Expect(l.image.At(20, 20)).To(Equal(dst), "channel mask 0x%X", int(op))
+			}
+		})
+
+		It("draws images with all channel masks", func() {
+			img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+			draw.Draw(img, img.Bounds(), image.NewUniform(src), image.Point{}, draw.Src)
+			for op, result := range expected {
+				prepare()
+				l.Draw(10, 10, img, op)
+				Expect(l.image.At(12, 12)).To(closeTo(result), "channel mask 0x%X", int(op))
+				Expect(l.image.At(20, 20)).To(Equal(dst), "channel mask 0x%X", int(op))
+			}
+		})
+
+		It("fills paths with all channel masks, only changing the pixels covered", func() {
+			for op, result := range expected {
+				prepare()
+				l.Rect(10, 10, 4, 4)
+				l.Fill(255, 0, 0, 102, op)
+				Expect(l.image.At(12, 12)).To(closeTo(result), "channel mask 0x%X", int(op))
+				Expect(l.image.At(9, 9)).To(Equal(dst), "channel mask 0x%X", int(op))
+				Expect(l.image.At(20, 20)).To(Equal(dst), "channel mask 0x%X", int(op))
+			}
+		})
+
+		It("strokes paths with all channel masks", func() {
+			for op, result := range expected {
+				prepare()
+				l.Start(5, 12)
+				l.Line(25, 12)
+				l.Stroke(capButt, joinMiter, 4, 255, 0, 0, 102, op)
+				Expect(l.image.At(12, 12)).To(closeTo(result), "channel mask 0x%X", int(op))
+				Expect(l.image.At(12, 20)).To(Equal(dst), "channel mask 0x%X", int(op))
+			}
+		})
+
+		It("fills paths with layers with all channel masks", func() {
+			for op, result := range expected {
+				prepare()
+				l.Rect(10, 10, 4, 4)
+				l.FillLayer(s, op)
+				Expect(l.image.At(12, 12)).To(closeTo(result), "channel mask 0x%X", int(op))
+				Expect(l.image.At(20, 20)).To(Equal(dst), "channel mask 0x%X", int(op))
+			}
+		})
+
+		It("blends partially covered pixels with the destination", func() {
+			prepare()
+			mask := image.NewRGBA(l.image.Bounds())
+			mask.Set(10, 10, color.RGBA{128, 128, 128, 128})
+			composite(l.image, image.Rect(10, 10, 12, 12), s.image, image.Point{}, mask, compClear)
+			Expect(l.image.At(10, 10)).To(Equal(color.RGBA{0, 0, 76, 102}))
+			Expect(l.image.At(11, 11)).To(Equal(dst))
+		})
+
+		It("copies overlapping areas of the same layer", func() {
+			prepare()
+			l.image.Set(0, 0, src)
+			l.Copy(l, 0, 0, 2, 2, 1, 1, compXor)
+			Expect(l.image.At(1, 1)).To(Equal(expected[compXor]))
+			// The source of this pixel is the destination before the copy
+			Expect(l.image.At(2, 2)).To(Equal(color.RGBA{0, 0, 61, 82}))
+		})
+	})
 })
@@ -0,0 +1,244 @@
+package bring
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/deluan/bring/protocol"
+)
+
+// StreamIndexMimetype is the mimetype of directory listings. The contents of a directory are a JSON
+// object, mapping the full path of each entry to its mimetype. Subdirectories have this same mimetype
+const StreamIndexMimetype = "application/vnd.glyptodon.guacamole.stream-index+json"
+
+// RootStream is the name of the root directory of all filesystem objects
+const RootStream = "/"
+
+// ErrObjectUndefined is returned by requests to filesystem objects that were removed by the server
+var ErrObjectUndefined = errors.New("object undefined")
+
+// Object is a filesystem exposed by the server, like a drive redirected with RDP or a SFTP connection.
+// Its contents are organized in streams, accessed by name. Directories are streams with StreamIndexMimetype
+type Object struct {
+	client *Client
+	index  int
+	Name   string
+}
+
+// OnFilesystemFunc is the signature for OnFilesystem event handlers
+type OnFilesystemFunc = func(o *Object)
+
+// OnFilesystem sets a function that will be called when the server exposes a new filesystem object
+func (c *Client) OnFilesystem(f OnFilesystemFunc) {
+	c.onFilesystem = f
+}
+
+// Objects returns all filesystem objects currently exposed by the server, ordered by their index
+func (c *Client) Objects() []*Object {
+	return c.objects.list()
+}
+
+// Get requests the stream name from the filesystem, returning its mimetype and a Reader for its contents.
+// The Reader must be read until EOF or closed, as the server waits for the data to be consumed before
+// sending more. It waits for the server response until the context is done, and must not be called from
+// an event handler
+func (o *Object) Get(ctx context.Context, name string) (mimetype string, r io.ReadCloser, err error) {
+	c := o.client
+	if c.session.getState() != SessionActive {
+		return "", nil, ErrNotConnected
+	}
+
+	req := objectRequest{object: o.index, name: name}
+	bodies := c.objects.expect(req)
+	if err := c.session.Send(protocol.NewInstruction("get", strconv.Itoa(o.index), name)); err != nil {
+		c.objects.cancel(req, bodies)
+		return "", nil, err
+	}
+
+	select {
+	case body, ok := <-bodies:
+		if !ok {
+			return "", nil, ErrObjectUndefined
+		}
+		return body.mimetype, body.reader, nil
+	case <-c.session.done:
+		c.objects.cancel(req, bodies)
+		return "", nil, ErrNotConnected
+	case <-ctx.Done():
+		c.objects.cancel(req, bodies)
+		return "", nil, ctx.Err()
+	}
+}
+
+// List returns the contents of the directory name, mapping the full path of each entry to its mimetype.
+// Use RootStream to list the root directory
+func (o *Object) List(ctx context.Context, name string) (map[string]string, error) {
+	mimetype, r, err := o.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if mimetype != StreamIndexMimetype {
+		return nil, fmt.Errorf("%s is not a directory (%s)", name, mimetype)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string]string{}
+	err = json.Unmarshal(data, &entries)
+	return entries, err
+}
+
+// Put sends the contents read from r to the filesystem, as the stream name. It blocks until all contents
+// are sent, and if the server refuses the stream or any part of it, returns a *StreamError. It must
+// not be called from an event handler
+func (o *Object) Put(name, mimetype string, r io.Reader) error {
+	c := o.client
+	if c.session.getState() != SessionActive {
+		return ErrNotConnected
+	}
+
+	s := c.streams.open()
+	defer c.streams.close(s)
+
+	put := protocol.NewInstruction("put", strconv.Itoa(o.index), strconv.Itoa(s.index), mimetype, name)
+	err := c.upload(s, put, r)
+	if err != nil {
+		c.logger.Errorf("Failed sending '%s' to %s: %s", name, o.Name, err)
+	}
+	return err
+}
+
+type objectRequest struct {
+	object int
+	name   string
+}
+
+// objectBody is the response of the server to a "get" request
+type objectBody struct {
+	mimetype string
+	reader   io.ReadCloser
+}
+
+// objects keeps the filesystem objects exposed by the server and the pending requests to them.
+// It is safe to be used from multiple goroutines
+type objects struct {
+	mutex   sync.Mutex
+	defined map[int]*Object
+	pending map[objectRequest][]chan *objectBody
+}
+
+func (m *objects) define(o *Object) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.defined == nil {
+		m.defined = make(map[int]*Object)
+	}
+	m.defined[o.index] = o
+}
+
+// undefine removes the object, failing all requests waiting for it
+func (m *objects) undefine(idx int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.defined, idx)
+	for req, waiting := range m.pending {
+		if req.object != idx {
+			continue
+		}
+		for _, ch := range waiting {
+			close(ch)
+		}
+		delete(m.pending, req)
+	}
+}
+
+// reset removes all objects, failing all pending requests
+func (m *objects) reset() {
+	m.mutex.Lock()
+	indexes := make([]int, 0, len(m.defined))
+	for idx := range m.defined {
+		indexes = append(indexes, idx)
+	}
+	m.mutex.Unlock()
+	for _, idx := range indexes {
+		m.undefine(idx)
+	}
+}
+
+func (m *objects) get(idx int) (*Object, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	o, ok := m.defined[idx]
+	return o, ok
+}
+
+func (m *objects) list() []*Object {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	list := make([]*Object, 0, len(m.defined))
+	for _, o := range m.defined {
+		list = append(list, o)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].index < list[j].index })
+	return list
+}
+
+// expect registers a request, returning the channel where its response will be delivered
+func (m *objects) expect(req objectRequest) chan *objectBody {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.pending == nil {
+		m.pending = make(map[objectRequest][]chan *objectBody)
+	}
+	ch := make(chan *objectBody, 1)
+	m.pending[req] = append(m.pending[req], ch)
+	return ch
+}
+
+// cancel a request. If its response was already delivered, it is discarded
+func (m *objects) cancel(req objectRequest, ch chan *objectBody) {
+	m.mutex.Lock()
+	waiting := m.pending[req]
+	for i, w := range waiting {
+		if w == ch {
+			m.pending[req] = append(waiting[:i], waiting[i+1:]...)
+			if len(m.pending[req]) == 0 {
+				delete(m.pending, req)
+			}
+			m.mutex.Unlock()
+			return
+		}
+	}
+	m.mutex.Unlock()
+
+	if body, ok := <-ch; ok {
+		_ = body.reader.Close()
+	}
+}
+
+// deliver the response to the oldest pending request. Returns false if there is no request waiting for it
+func (m *objects) deliver(req objectRequest, body *objectBody) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	waiting := m.pending[req]
+	if len(waiting) == 0 {
+		return false
+	}
+	waiting[0] <- body
+	if len(waiting) == 1 {
+		delete(m.pending, req)
+	} else {
+		m.pending[req] = waiting[1:]
+	}
+	return true
+}
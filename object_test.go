@@ -0,0 +1,137 @@
+package bring
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deluan/bring/protocol"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Filesystem objects", func() {
+	var c *Client
+	var t *mockTunnel
+	var o *Object
+	var responding sync.WaitGroup
+
+	BeforeEach(func() {
+		t = &mockTunnel{}
+		c = newTestClient(t)
+
+		var announced *Object
+		c.OnFilesystem(func(obj *Object) {
+			announced = obj
+		})
+		Expect(handlers["filesystem"](c, []string{"2", "Shared Drive"})).To(Succeed())
+		Expect(announced).ToNot(BeNil())
+		o = announced
+	})
+
+	AfterEach(func() {
+		// The responses can still be sent after the spec is done with the client
+		responding.Wait()
+	})
+
+	// respond waits, in the background, for the "get" request and sends the contents as the server would
+	respond := func(name, mimetype, contents string) {
+		responding.Add(1)
+		go func() {
+			defer responding.Done()
+			defer GinkgoRecover()
+			Eventually(t.sentInstructions).Should(ContainElement(protocol.NewInstruction("get", "2", name)))
+			Expect(handlers["body"](c, []string{"2", "7", mimetype, name})).To(Succeed())
+			Expect(handlers["blob"](c, []string{"7", base64.StdEncoding.EncodeToString([]byte(contents))})).To(Succeed())
+			Expect(handlers["end"](c, []string{"7"})).To(Succeed())
+		}()
+	}
+
+	It("keeps the objects announced by the server", func() {
+		Expect(o.Name).To(Equal("Shared Drive"))
+		Expect(c.Objects()).To(Equal([]*Object{o}))
+
+		Expect(handlers["undefine"](c, []string{"2"})).To(Succeed())
+		Expect(c.Objects()).To(BeEmpty())
+	})
+
+	It("lists directories", func() {
+		respond(RootStream, StreamIndexMimetype, `{"/docs":"`+StreamIndexMimetype+`","/notes.txt":"text/plain"}`)
+
+		entries, err := o.List(context.Background(), RootStream)
+		Expect(err).To(BeNil())
+		Expect(entries).To(Equal(map[string]string{
+			"/docs":      StreamIndexMimetype,
+			"/notes.txt": "text/plain",
+		}))
+		Eventually(t.sentInstructions).Should(ContainElement(protocol.NewInstruction("ack", "7", "Ready", "0")))
+	})
+
+	It("fails to list files", func() {
+		respond("/notes.txt", "text/plain", "bring it on")
+
+		_, err := o.List(context.Background(), "/notes.txt")
+		Expect(err).To(MatchError(ContainSubstring("not a directory")))
+	})
+
+	It("downloads files", func() {
+		respond("/notes.txt", "text/plain", "bring it on")
+
+		mimetype, r, err := o.Get(context.Background(), "/notes.txt")
+		Expect(err).To(BeNil())
+		defer r.Close()
+		Expect(mimetype).To(Equal("text/plain"))
+		data, err := ioutil.ReadAll(r)
+		Expect(err).To(BeNil())
+		Expect(string(data)).To(Equal("bring it on"))
+	})
+
+	It("stops waiting when the context is done", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, _, err := o.Get(ctx, "/notes.txt")
+		Expect(err).To(Equal(context.DeadlineExceeded))
+		Expect(c.objects.pending).To(BeEmpty())
+	})
+
+	It("fails pending requests when the object is undefined", func() {
+		go func() {
+			defer GinkgoRecover()
+			Eventually(t.sentInstructions).Should(HaveLen(1))
+			Expect(handlers["undefine"](c, []string{"2"})).To(Succeed())
+		}()
+
+		_, _, err := o.Get(context.Background(), "/notes.txt")
+		Expect(err).To(Equal(ErrObjectUndefined))
+	})
+
+	It("refuses contents that were not requested", func() {
+		Expect(handlers["body"](c, []string{"2", "7", "text/plain", "/other.txt"})).To(Succeed())
+		Expect(t.sent).To(Equal([]*protocol.Instruction{
+			protocol.NewInstruction("ack", "7", "Unexpected stream", "768"),
+		}))
+	})
+
+	It("uploads files", func() {
+		result := make(chan error, 1)
+		go func() {
+			result <- o.Put("/notes.txt", "text/plain", strings.NewReader("bring it on"))
+		}()
+
+		Eventually(t.sentInstructions).Should(HaveLen(1))
+		Expect(t.sentInstructions()[0]).To(Equal(protocol.NewInstruction("put", "2", "0", "text/plain", "/notes.txt")))
+		Expect(handlers["ack"](c, []string{"0", "OK", "0"})).To(Succeed())
+		Eventually(t.sentInstructions).Should(HaveLen(2))
+		Expect(handlers["ack"](c, []string{"0", "OK", "0"})).To(Succeed())
+
+		Eventually(result).Should(Receive(BeNil()))
+		Expect(t.sentInstructions()[1:]).To(Equal([]*protocol.Instruction{
+			protocol.NewInstruction("blob", "0", "YnJpbmcgaXQgb24="),
+			protocol.NewInstruction("end", "0"),
+		}))
+	})
+})
@@ -0,0 +1,188 @@
+package bring
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+
+	"github.com/deluan/bring/protocol"
+)
+
+// ErrNoTunnel is returned by NewClientWithOptions if no tunnel, dialer or address is specified
+var ErrNoTunnel = errors.New("no tunnel specified")
+
+// Dialer is a function that creates the tunnel used by the Client to communicate with the server.
+// The tunnel returned must not be connected yet, as the Client will connect it
+type Dialer = func() (protocol.Tunnel, error)
+
+// Option configures a Client created with NewClientWithOptions
+type Option func(o *options)
+
+type options struct {
+	logger        Logger
+	dialer        Dialer
+	reconnect     *ReconnectPolicy
+	connectionID  string
+	readOnly      bool
+	onStateChange OnStateChangeFunc
+	videoDecoder  VideoDecoder
+	handshake     handshakeOptions
+}
+
+// Client capabilities and information sent to the server during the handshake
+type handshakeOptions struct {
+	dpi            int
+	audioMimetypes []string
+	videoMimetypes []string
+	imageMimetypes []string
+	timezone       string
+	name           string
+}
+
+const defaultDPI = 96
+
+var defaultImageMimetypes = []string{"image/png", "image/jpeg", "image/webp"}
+
+// WithLogger sets the Logger used by the Client. If not specified, a DefaultLogger is used
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithTunnel makes the Client use the tunnel provided to communicate with the server. This
+// allows using any transport (ex: WebSocket or HTTP tunnels), or wrapping an existing one
+func WithTunnel(tunnel protocol.Tunnel) Option {
+	return WithDialer(func() (protocol.Tunnel, error) {
+		return tunnel, nil
+	})
+}
+
+// WithDialer makes the Client call the dialer provided to create the tunnel it will use
+func WithDialer(dialer Dialer) Option {
+	return func(o *options) {
+		o.dialer = dialer
+	}
+}
+
+// WithAddress makes the Client connect directly to the guacd server at the address
+// provided, using a TCP socket
+func WithAddress(addr string) Option {
+	return WithDialer(func() (protocol.Tunnel, error) {
+		return protocol.NewInetSocketTunnel(addr)
+	})
+}
+
+// WithTLSAddress makes the Client connect directly to the guacd server at the address
+// provided, using a TLS encrypted TCP socket configured by config
+func WithTLSAddress(addr string, config *tls.Config) Option {
+	return WithDialer(func() (protocol.Tunnel, error) {
+		return protocol.NewTLSSocketTunnel(addr, config)
+	})
+}
+
+// WithUnixSocket makes the Client connect to a co-located guacd server listening on the
+// Unix domain socket at path
+func WithUnixSocket(path string) Option {
+	return WithDialer(func() (protocol.Tunnel, error) {
+		return protocol.NewUnixSocketTunnel(path)
+	})
+}
+
+// WithJoin makes the Client join the existing connection identified by connectionID, instead of
+// creating a new one. This allows multiple clients to share the same remote session. The connection ID
+// of an active session can be obtained with Client.ConnectionID. When joining a connection, the remote
+// protocol passed to the constructor is ignored
+func WithJoin(connectionID string) Option {
+	return func(o *options) {
+		o.connectionID = connectionID
+	}
+}
+
+// WithReadOnly makes the Client join the connection as a read-only user, only able to observe it. The
+// server ignores any input sent by read-only users. It only has effect when used with WithJoin
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// WithStateChange sets a function that will be called every time the session state changes, like
+// Client.OnStateChange. As it is set before connecting, the changes while the session is being
+// established (ex: from SessionClosed to SessionHandshake) are also notified
+func WithStateChange(f OnStateChangeFunc) Option {
+	return func(o *options) {
+		o.onStateChange = f
+	}
+}
+
+// WithDPI sets the resolution of the display, in DPI, requested during the handshake. Default is 96
+func WithDPI(dpi int) Option {
+	return func(o *options) {
+		o.handshake.dpi = dpi
+	}
+}
+
+// WithAudioMimetypes sets the audio mimetypes the Client reports as supported to the server.
+// The Client can only decode raw PCM audio. Default is audio/L8 and audio/L16
+func WithAudioMimetypes(mimetypes ...string) Option {
+	return func(o *options) {
+		o.handshake.audioMimetypes = mimetypes
+	}
+}
+
+// WithVideoMimetypes sets the video mimetypes the Client reports as supported to the server.
+// Default is the mimetypes supported by the VideoDecoder set with WithVideoDecoder
+func WithVideoMimetypes(mimetypes ...string) Option {
+	return func(o *options) {
+		o.handshake.videoMimetypes = mimetypes
+	}
+}
+
+// WithImageMimetypes sets the image mimetypes the Client reports as supported to the server.
+// The Client can only decode the image formats registered with the image package.
+// Default is image/png, image/jpeg and image/webp
+func WithImageMimetypes(mimetypes ...string) Option {
+	return func(o *options) {
+		o.handshake.imageMimetypes = mimetypes
+	}
+}
+
+// WithTimezone sets the timezone sent to the server, in IANA format (ex: America/New_York). Only sent
+// if the server supports it. Default is the value of the TZ environment variable, if set
+func WithTimezone(timezone string) Option {
+	return func(o *options) {
+		o.handshake.timezone = timezone
+	}
+}
+
+// WithName sets the name of the user, sent to the server. Only sent if the server supports it
+func WithName(name string) Option {
+	return func(o *options) {
+		o.handshake.name = name
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		handshake: handshakeOptions{
+			dpi:            defaultDPI,
+			audioMimetypes: defaultAudioMimetypes,
+			imageMimetypes: defaultImageMimetypes,
+			timezone:       os.Getenv("TZ"),
+		},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.logger == nil {
+		o.logger = &DefaultLogger{}
+	}
+	if o.videoDecoder == nil {
+		o.videoDecoder = nopVideoDecoder{}
+	}
+	if o.handshake.videoMimetypes == nil {
+		o.handshake.videoMimetypes = o.videoDecoder.Mimetypes()
+	}
+	return o
+}
@@ -0,0 +1,80 @@
+package bring
+
+import (
+	"io"
+	"strconv"
+
+	"github.com/deluan/bring/protocol"
+)
+
+// Name of the pipe used by SSH and telnet connections as the terminal's standard input
+const StdinPipe = "STDIN"
+
+// OnPipeFunc is the signature for OnPipe event handlers. It will receive the name and mimetype of the pipe
+// opened by the server, and a Reader for the data sent through it
+type OnPipeFunc = func(name, mimetype string, r io.Reader)
+
+// OnPipe sets a function that will be called when the server opens a named pipe to the Client. The handler
+// is called in its own goroutine, and must read the pipe until EOF: the server only sends more data after
+// the previous one is read, and the pipe is closed if the handler returns before reading all of it. If no
+// handler is set, all pipes are refused
+func (c *Client) OnPipe(f OnPipeFunc) {
+	c.onPipe = f
+}
+
+// OpenPipe opens a named pipe to the server, returning a Writer for the data to send through it. Which pipes
+// are available depends on the remote protocol. For example, StdinPipe in SSH and telnet connections
+// replaces the keyboard input of the terminal. It returns a *StreamError if the server refuses the pipe.
+// Each write blocks until the server acknowledges the data, so OpenPipe and the Writer returned must not be
+// used from an event handler. The Writer is not safe for concurrent use, and must be closed when done
+func (c *Client) OpenPipe(name, mimetype string) (io.WriteCloser, error) {
+	if c.session.getState() != SessionActive {
+		return nil, ErrNotConnected
+	}
+
+	s := c.streams.open()
+	err := c.streams.write(s, protocol.NewInstruction("pipe", strconv.Itoa(s.index), mimetype, name))
+	if err == nil {
+		err = s.wait(c.session.done)
+	}
+	if err != nil {
+		c.logger.Errorf("Failed opening pipe '%s': %s", name, err)
+		c.streams.close(s)
+		return nil, err
+	}
+	return &pipeWriter{client: c, stream: s}, nil
+}
+
+type pipeWriter struct {
+	client *Client
+	stream *outputStream
+	closed bool
+}
+
+func (w *pipeWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxBlobLength {
+			n = maxBlobLength
+		}
+		if err := w.client.sendBlob(w.stream, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *pipeWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.client.streams.close(w.stream)
+	return w.client.session.Send(protocol.NewInstruction("end", strconv.Itoa(w.stream.index)))
+}
@@ -0,0 +1,104 @@
+package bring
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/deluan/bring/protocol"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pipes", func() {
+	var c *Client
+	var t *mockTunnel
+
+	BeforeEach(func() {
+		t = &mockTunnel{}
+		c = newTestClient(t)
+	})
+
+	Describe("Inbound", func() {
+		It("passes the data received to the handler", func() {
+			received := make(chan string)
+			c.OnPipe(func(name, mimetype string, r io.Reader) {
+				data, err := ioutil.ReadAll(r)
+				Expect(err).To(BeNil())
+				received <- name + "|" + mimetype + "|" + string(data)
+			})
+
+			Expect(handlers["pipe"](c, []string{"3", "text/plain", "output"})).To(Succeed())
+			Expect(handlers["blob"](c, []string{"3", "YnJpbmcgaXQgb24="})).To(Succeed())
+			Expect(handlers["end"](c, []string{"3"})).To(Succeed())
+
+			Eventually(received).Should(Receive(Equal("output|text/plain|bring it on")))
+			Eventually(t.sentInstructions).Should(Equal([]*protocol.Instruction{
+				protocol.NewInstruction("ack", "3", "Ready", "0"),
+				protocol.NewInstruction("ack", "3", "OK", "0"),
+			}))
+		})
+
+		It("refuses pipes if there is no handler", func() {
+			Expect(handlers["pipe"](c, []string{"3", "text/plain", "output"})).To(Succeed())
+			Expect(t.sent).To(Equal([]*protocol.Instruction{
+				protocol.NewInstruction("ack", "3", "Pipes unsupported", "256"),
+			}))
+		})
+	})
+
+	Describe("Outbound", func() {
+		ack := func(status string) {
+			Expect(handlers["ack"](c, []string{"0", "OK", status})).To(Succeed())
+		}
+
+		It("writes to the pipe, waiting for the server acknowledgements", func() {
+			opened := make(chan io.WriteCloser)
+			go func() {
+				defer GinkgoRecover()
+				w, err := c.OpenPipe(StdinPipe, "text/plain")
+				Expect(err).To(BeNil())
+				opened <- w
+			}()
+			Eventually(t.sentInstructions).Should(HaveLen(1))
+			Expect(t.sentInstructions()[0]).To(Equal(protocol.NewInstruction("pipe", "0", "text/plain", "STDIN")))
+			ack("0")
+
+			var w io.WriteCloser
+			Eventually(opened).Should(Receive(&w))
+			written := make(chan int)
+			go func() {
+				defer GinkgoRecover()
+				n, err := io.Copy(w, strings.NewReader("ls -l\n"))
+				Expect(err).To(BeNil())
+				written <- int(n)
+			}()
+			Eventually(t.sentInstructions).Should(HaveLen(2))
+			Consistently(written, "50ms").ShouldNot(Receive())
+			ack("0")
+			Eventually(written).Should(Receive(Equal(6)))
+
+			Expect(w.Close()).To(Succeed())
+			Expect(t.sentInstructions()[1:]).To(Equal([]*protocol.Instruction{
+				protocol.NewInstruction("blob", "0", "bHMgLWwK"),
+				protocol.NewInstruction("end", "0"),
+			}))
+			_, err := w.Write([]byte("more"))
+			Expect(err).To(Equal(io.ErrClosedPipe))
+		})
+
+		It("returns the error sent by the server when the pipe is refused", func() {
+			result := make(chan error, 1)
+			go func() {
+				_, err := c.OpenPipe("unknown", "text/plain")
+				result <- err
+			}()
+			Eventually(t.sentInstructions).Should(HaveLen(1))
+			ack("516")
+
+			var err error
+			Eventually(result).Should(Receive(&err))
+			Expect(err).To(Equal(&StreamError{Index: 0, Status: StatusResourceNotFound, Message: "OK"}))
+		})
+	})
+})
@@ -0,0 +1,246 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Header used by the Guacamole HTTP tunnel to identify the tunnel in all requests after connect
+const tunnelTokenHeader = "Guacamole-Tunnel-Token"
+
+// HTTPTunnel implements the Tunnel interface using the Guacamole HTTP tunnel protocol, as provided
+// by the GuacamoleHTTPTunnelServlet (ex: http://host/guacamole/tunnel). It is useful when the
+// network path between the client and the server does not support WebSockets.
+// Instructions are received by long-polling "read" requests and sent with "write" requests, both
+// identified by the tunnel UUID returned by the server on connect
+type HTTPTunnel struct {
+	url        string
+	client     *http.Client
+	requestId  int
+	input      *bufio.Reader
+	writeMutex sync.Mutex
+
+	// Guards the fields below, used by the goroutines sending, receiving and disconnecting
+	mutex    sync.Mutex
+	header   http.Header
+	state    TunnelState
+	uuid     string
+	response io.ReadCloser
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// NewHTTPTunnel creates a tunnel that will connect to the Guacamole HTTP tunnel endpoint at the
+// url provided. The header is optional and, if present, will be sent with all requests
+func NewHTTPTunnel(url string, header ...http.Header) (*HTTPTunnel, error) {
+	t := &HTTPTunnel{
+		url:    url,
+		client: &http.Client{},
+		header: http.Header{},
+	}
+	if len(header) > 0 {
+		t.header = header[0].Clone()
+	}
+	return t, nil
+}
+
+// UUID returns the unique identifier assigned to this tunnel by the server
+func (t *HTTPTunnel) UUID() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.uuid
+}
+
+// Connect requests a new tunnel from the server. The data is sent as the body of the connect request
+func (t *HTTPTunnel) Connect(data string) error {
+	return t.ConnectContext(context.Background(), data)
+}
+
+// ConnectContext requests a new tunnel from the server like Connect, using the context provided for
+// the connect request only. All requests made after that are cancelled when the tunnel is disconnected
+func (t *HTTPTunnel) ConnectContext(ctx context.Context, data string) error {
+	resp, err := t.request(ctx, http.MethodPost, "connect", "application/x-www-form-urlencoded; charset=UTF-8",
+		strings.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	uuid, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if len(uuid) == 0 {
+		return ErrInvalidUUID
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.uuid = string(uuid)
+	t.requestId = 0
+	t.header.Set(tunnelTokenHeader, t.uuid)
+	if t.cancel != nil {
+		t.cancel()
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	t.state = TunnelOpen
+	return nil
+}
+
+func (t *HTTPTunnel) Disconnect() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.state == TunnelClosed {
+		return
+	}
+
+	t.state = TunnelClosed
+	if t.cancel != nil {
+		t.cancel()
+	}
+	if t.response != nil {
+		_ = t.response.Close()
+	}
+}
+
+// session returns the context and the UUID used by the requests of the open tunnel
+func (t *HTTPTunnel) session() (context.Context, string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.state != TunnelOpen {
+		return nil, "", ErrNotConnected
+	}
+	return t.ctx, t.uuid, nil
+}
+
+func (t *HTTPTunnel) SendInstruction(ins ...*Instruction) error {
+	ctx, uuid, err := t.session()
+	if err != nil {
+		return err
+	}
+
+	if len(ins) == 0 {
+		return nil
+	}
+
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+
+	var buf bytes.Buffer
+	for _, in := range ins {
+		buf.WriteString(in.String())
+	}
+	resp, err := t.request(ctx, http.MethodPost, "write:"+uuid, "application/octet-stream", &buf)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// ReceiveInstruction returns the next instruction sent by the server. A new read request is
+// issued every time the server ends the current one
+func (t *HTTPTunnel) ReceiveInstruction() (*Instruction, error) {
+	for {
+		ctx, uuid, err := t.session()
+		if err != nil {
+			return nil, err
+		}
+
+		if t.input == nil {
+			if err := t.startRead(ctx, uuid); err != nil {
+				return nil, err
+			}
+		}
+
+		raw, err := t.input.ReadBytes(byte(';'))
+		if err != nil {
+			t.endRead()
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		ins, err := ParseInstruction(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		// An empty instruction marks the end of the current read request
+		if ins.Opcode == internalDataOpcode && len(ins.Args) == 0 {
+			t.endRead()
+			continue
+		}
+		if ins.Opcode == internalDataOpcode {
+			continue
+		}
+		return ins, nil
+	}
+}
+
+func (t *HTTPTunnel) startRead(ctx context.Context, uuid string) error {
+	resp, err := t.request(ctx, http.MethodGet, "read:"+uuid+":"+strconv.Itoa(t.requestId), "", nil)
+	if err != nil {
+		return err
+	}
+	t.requestId++
+	t.mutex.Lock()
+	t.response = resp.Body
+	t.mutex.Unlock()
+	t.input = bufio.NewReaderSize(resp.Body, maxInstructionLength)
+	return nil
+}
+
+func (t *HTTPTunnel) endRead() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.response != nil {
+		_ = t.response.Close()
+	}
+	t.response = nil
+	t.input = nil
+}
+
+func (t *HTTPTunnel) request(ctx context.Context, method, query, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, t.url+"?"+query, body)
+	if err != nil {
+		return nil, err
+	}
+	t.mutex.Lock()
+	for k, v := range t.header {
+		req.Header[k] = v
+	}
+	t.mutex.Unlock()
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, httpTunnelError(resp)
+	}
+	return resp, nil
+}
+
+// httpTunnelError builds an error from the status headers sent by the tunnel servlet, falling
+// back to the HTTP status if they are not present
+func httpTunnelError(resp *http.Response) error {
+	code := resp.Header.Get("Guacamole-Status-Code")
+	msg := resp.Header.Get("Guacamole-Error-Message")
+	if code == "" {
+		return fmt.Errorf("tunnel request failed: %s", resp.Status)
+	}
+	return fmt.Errorf("tunnel request failed with status %s: %s", code, msg)
+}
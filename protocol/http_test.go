@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const httpTunnelUUID = "8c4e1a0a-7d0b-4f51-a5a1-3e4f0b7f5d60"
+
+type fakeTunnelServlet struct {
+	sync.Mutex
+	connectData string
+	reads       []string
+	written     []string
+	tokens      []string
+	hangReads   bool
+}
+
+func (s *fakeTunnelServlet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Keeps the read requests waiting, without sending any response, until the client gives up
+	if s.hangReads && strings.HasPrefix(r.URL.RawQuery, "read:") {
+		<-r.Context().Done()
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	s.tokens = append(s.tokens, r.Header.Get(tunnelTokenHeader))
+	switch q := r.URL.RawQuery; q {
+	case "connect":
+		s.connectData = string(body)
+		_, _ = w.Write([]byte(httpTunnelUUID))
+	case "read:" + httpTunnelUUID + ":0":
+		_, _ = w.Write([]byte("4.args,8.hostname;0.;"))
+	case "read:" + httpTunnelUUID + ":1":
+		_, _ = w.Write([]byte("5.ready,4.abcd;0.;"))
+	case "write:" + httpTunnelUUID:
+		s.written = append(s.written, string(body))
+	default:
+		w.Header().Set("Guacamole-Status-Code", "514")
+		w.Header().Set("Guacamole-Error-Message", "Connection closed")
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+var _ = Describe("HTTPTunnel", func() {
+	var (
+		servlet *fakeTunnelServlet
+		server  *httptest.Server
+		t       *HTTPTunnel
+	)
+
+	BeforeEach(func() {
+		servlet = &fakeTunnelServlet{}
+		server = httptest.NewServer(servlet)
+		t, _ = NewHTTPTunnel(server.URL)
+	})
+
+	AfterEach(func() {
+		t.Disconnect()
+		server.Close()
+	})
+
+	It("gets the tunnel UUID when connecting", func() {
+		Expect(t.Connect("token=abc")).To(Succeed())
+		Expect(t.UUID()).To(Equal(httpTunnelUUID))
+		Expect(servlet.connectData).To(Equal("token=abc"))
+	})
+
+	It("receives instructions from consecutive read requests", func() {
+		Expect(t.Connect("")).To(Succeed())
+
+		ins, err := t.ReceiveInstruction()
+		Expect(err).To(BeNil())
+		Expect(ins).To(Equal(NewInstruction("args", "hostname")))
+
+		ins, err = t.ReceiveInstruction()
+		Expect(err).To(BeNil())
+		Expect(ins).To(Equal(NewInstruction("ready", "abcd")))
+
+		_, err = t.ReceiveInstruction()
+		Expect(err).To(MatchError(ContainSubstring("514")))
+		Expect(servlet.tokens[1:]).To(HaveEach(httpTunnelUUID))
+	})
+
+	It("sends all instructions in a single write request", func() {
+		Expect(t.Connect("")).To(Succeed())
+
+		err := t.SendInstruction(NewInstruction("select", "vnc"), NewInstruction("size", "1024", "768", "96"))
+		Expect(err).To(BeNil())
+		Expect(servlet.written).To(Equal([]string{"6.select,3.vnc;4.size,4.1024,3.768,2.96;"}))
+	})
+
+	It("cancels the pending requests when disconnected", func() {
+		servlet.hangReads = true
+		Expect(t.Connect("")).To(Succeed())
+
+		errC := make(chan error, 1)
+		go func() {
+			_, err := t.ReceiveInstruction()
+			errC <- err
+		}()
+
+		Consistently(errC, 100*time.Millisecond).ShouldNot(Receive())
+		t.Disconnect()
+		Eventually(errC).Should(Receive(HaveOccurred()))
+	})
+
+	It("does not send instructions when disconnected", func() {
+		err := t.SendInstruction(NewInstruction("nop"))
+		Expect(err).To(Equal(ErrNotConnected))
+	})
+})
@@ -1,6 +1,8 @@
 package protocol
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"net"
 	"sync"
@@ -35,20 +37,64 @@ type Tunnel interface {
 	ReceiveInstruction() (*Instruction, error)
 }
 
+// ContextConnector is implemented by tunnels that can use a context to control the connection attempt.
+// The context only applies to establishing the connection: once connected, its expiration
+// does not affect the tunnel
+type ContextConnector interface {
+	ConnectContext(ctx context.Context, data string) error
+}
+
+// Connect the tunnel using ConnectContext, if supported by the tunnel implementation.
+// Otherwise, fall back to the tunnel's Connect
+func Connect(ctx context.Context, t Tunnel, data string) error {
+	if c, ok := t.(ContextConnector); ok {
+		return c.ConnectContext(ctx, data)
+	}
+	return t.Connect(data)
+}
+
 const connectionTimeout = 5 * time.Second
 
-// Simple tunnel implementation over TCP sockets. This allows to connect directly to guacd,
-// without the need of any middleware
+// Simple tunnel implementation over network sockets. This allows to connect directly to guacd,
+// without the need of any middleware. Any stream oriented network supported by the net package
+// can be used (ex: TCP or Unix domain sockets), and the connection can optionally be encrypted with TLS
 type InetSocketTunnel struct {
+	network    string
 	address    string
+	tlsConfig  *tls.Config
 	socket     net.Conn
 	state      TunnelState
 	io         *InstructionIO
 	writeMutex sync.Mutex
 }
 
+// NewInetSocketTunnel creates a tunnel that connects to guacd using a TCP socket
 func NewInetSocketTunnel(address string) (*InetSocketTunnel, error) {
-	t := &InetSocketTunnel{address: address}
+	return NewSocketTunnel("tcp", address)
+}
+
+// NewUnixSocketTunnel creates a tunnel that connects to a co-located guacd using a Unix domain
+// socket, identified by its path
+func NewUnixSocketTunnel(path string) (*InetSocketTunnel, error) {
+	return NewSocketTunnel("unix", path)
+}
+
+// NewSocketTunnel creates a tunnel that connects to guacd using the network and address provided.
+// See net.Dial for the supported networks and address formats
+func NewSocketTunnel(network, address string) (*InetSocketTunnel, error) {
+	t := &InetSocketTunnel{network: network, address: address}
+
+	return t, nil
+}
+
+// NewTLSSocketTunnel creates a tunnel that connects directly to a guacd server with SSL/TLS enabled.
+// The config is used to set the CA bundle, client certificates, server name and any other TLS
+// options. If it is nil, the default TLS configuration is used
+func NewTLSSocketTunnel(address string, config *tls.Config) (*InetSocketTunnel, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	t := &InetSocketTunnel{network: "tcp", address: address, tlsConfig: config}
 
 	return t, nil
 }
@@ -85,7 +131,21 @@ func (t *InetSocketTunnel) ReceiveInstruction() (*Instruction, error) {
 }
 
 func (t *InetSocketTunnel) Connect(data string) error {
-	sock, err := net.DialTimeout("tcp", t.address, connectionTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+	defer cancel()
+	return t.ConnectContext(ctx, data)
+}
+
+func (t *InetSocketTunnel) ConnectContext(ctx context.Context, data string) error {
+	var sock net.Conn
+	var err error
+	if t.tlsConfig != nil {
+		dialer := &tls.Dialer{Config: t.tlsConfig}
+		sock, err = dialer.DialContext(ctx, t.network, t.address)
+	} else {
+		dialer := &net.Dialer{}
+		sock, err = dialer.DialContext(ctx, t.network, t.address)
+	}
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("InetSocketTunnel", func() {
+	Context("with Unix domain sockets", func() {
+		var (
+			ln  net.Listener
+			dir string
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "bring")
+			Expect(err).To(BeNil())
+			ln, err = net.Listen("unix", filepath.Join(dir, "guacd.sock"))
+			Expect(err).To(BeNil())
+			go echoServer(ln)
+		})
+
+		AfterEach(func() {
+			ln.Close()
+			os.RemoveAll(dir)
+		})
+
+		It("exchanges instructions through the socket", func() {
+			t, _ := NewUnixSocketTunnel(filepath.Join(dir, "guacd.sock"))
+			Expect(t.Connect("")).To(Succeed())
+			defer t.Disconnect()
+
+			Expect(t.SendInstruction(NewInstruction("select", "vnc"))).To(Succeed())
+			Expect(t.ReceiveInstruction()).To(Equal(NewInstruction("echo", "vnc")))
+		})
+	})
+
+	Context("with TLS", func() {
+		var (
+			ln      net.Listener
+			rootCAs *x509.CertPool
+		)
+
+		BeforeEach(func() {
+			// Borrow the self-signed certificate generated by httptest
+			certServer := httptest.NewTLSServer(nil)
+			certServer.Close()
+			rootCAs = x509.NewCertPool()
+			rootCAs.AddCert(certServer.Certificate())
+
+			var err error
+			ln, err = tls.Listen("tcp", "127.0.0.1:0", certServer.TLS)
+			Expect(err).To(BeNil())
+			go echoServer(ln)
+		})
+
+		AfterEach(func() {
+			ln.Close()
+		})
+
+		It("exchanges instructions over an encrypted connection", func() {
+			t, _ := NewTLSSocketTunnel(ln.Addr().String(), &tls.Config{RootCAs: rootCAs, ServerName: "example.com"})
+			Expect(t.Connect("")).To(Succeed())
+			defer t.Disconnect()
+
+			Expect(t.SendInstruction(NewInstruction("select", "vnc"))).To(Succeed())
+			Expect(t.ReceiveInstruction()).To(Equal(NewInstruction("echo", "vnc")))
+		})
+
+		It("fails to connect if the server certificate is not trusted", func() {
+			t, _ := NewTLSSocketTunnel(ln.Addr().String(), &tls.Config{ServerName: "example.com"})
+			Expect(t.Connect("")).ToNot(Succeed())
+		})
+	})
+})
+
+// echoServer accepts a single connection and replies to the first instruction received with
+// an "echo" instruction containing the same arguments
+func echoServer(ln net.Listener) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	io := NewInstructionIO(conn)
+	ins, err := io.Read()
+	if err != nil {
+		return
+	}
+	_, _ = io.Write(NewInstruction("echo", ins.Args...))
+}
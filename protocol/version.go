@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Version of the Guacamole protocol, as negotiated during the handshake
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// Known protocol versions
+var (
+	// Version100 is the version used by servers that do not report their version during the handshake
+	Version100 = Version{1, 0, 0}
+	// Version110 introduced the "timezone" handshake instruction
+	Version110 = Version{1, 1, 0}
+	// Version130 introduced the "required" instruction
+	Version130 = Version{1, 3, 0}
+	// Version150 introduced the "name" handshake instruction
+	Version150 = Version{1, 5, 0}
+	// LatestVersion is the latest version supported by this library
+	LatestVersion = Version150
+)
+
+var versionRegex = regexp.MustCompile(`^VERSION_(\d+)_(\d+)_(\d+)$`)
+
+// ParseVersion parses a version in the format sent by the server in the "args" instruction
+// (ex: VERSION_1_5_0). Returns false if s is not a valid version
+func ParseVersion(s string) (Version, bool) {
+	m := versionRegex.FindStringSubmatch(s)
+	if m == nil {
+		return Version{}, false
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	patch, _ := strconv.Atoi(m[3])
+	return Version{major, minor, patch}, true
+}
+
+// AtLeast returns true if this version is the same or newer than other
+func (v Version) AtLeast(other Version) bool {
+	if v.Major != other.Major {
+		return v.Major > other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor > other.Minor
+	}
+	return v.Patch >= other.Patch
+}
+
+// String returns the version in the format used by the protocol (ex: VERSION_1_5_0)
+func (v Version) String() string {
+	return fmt.Sprintf("VERSION_%d_%d_%d", v.Major, v.Minor, v.Patch)
+}
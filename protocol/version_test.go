@@ -0,0 +1,32 @@
+package protocol
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Version", func() {
+	It("parses versions sent by the server", func() {
+		v, ok := ParseVersion("VERSION_1_3_12")
+		Expect(ok).To(BeTrue())
+		Expect(v).To(Equal(Version{1, 3, 12}))
+	})
+
+	It("does not parse invalid versions", func() {
+		_, ok := ParseVersion("hostname")
+		Expect(ok).To(BeFalse())
+		_, ok = ParseVersion("VERSION_1_5")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("compares versions", func() {
+		Expect(Version150.AtLeast(Version110)).To(BeTrue())
+		Expect(Version110.AtLeast(Version110)).To(BeTrue())
+		Expect(Version100.AtLeast(Version110)).To(BeFalse())
+		Expect(Version{2, 0, 0}.AtLeast(Version{1, 9, 9})).To(BeTrue())
+	})
+
+	It("formats versions in the protocol format", func() {
+		Expect(Version150.String()).To(Equal("VERSION_1_5_0"))
+	})
+})
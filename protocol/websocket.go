@@ -0,0 +1,185 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket subprotocol used by Guacamole's WebSocket tunnel endpoints
+const webSocketSubprotocol = "guacamole"
+
+// Opcode of the internal instructions, used by the tunnels to send data that is not part of the
+// Guacamole protocol itself (like the tunnel UUID), as defined in guacamole-common
+const internalDataOpcode = ""
+
+// ErrInvalidUUID is returned when the tunnel receives a malformed UUID instruction
+var ErrInvalidUUID = errors.New("invalid tunnel UUID")
+
+// WebSocketTunnel implements the Tunnel interface over a WebSocket connection, using the "guacamole"
+// subprotocol. It can connect to any guacamole-client compatible WebSocket endpoint, like
+// the ones provided by the Guacamole web application (ex: ws://host/guacamole/websocket-tunnel)
+type WebSocketTunnel struct {
+	url        string
+	header     http.Header
+	dialer     *websocket.Dialer
+	conn       *websocket.Conn
+	state      TunnelState
+	uuid       string
+	io         *InstructionIO
+	writeMutex sync.Mutex
+}
+
+// NewWebSocketTunnel creates a tunnel that will connect to the WebSocket endpoint at the url provided.
+// The header is optional and, if present, will be sent with the opening handshake request
+func NewWebSocketTunnel(url string, header ...http.Header) (*WebSocketTunnel, error) {
+	t := &WebSocketTunnel{
+		url: url,
+		dialer: &websocket.Dialer{
+			Proxy:        http.ProxyFromEnvironment,
+			Subprotocols: []string{webSocketSubprotocol},
+		},
+	}
+	if len(header) > 0 {
+		t.header = header[0]
+	}
+	return t, nil
+}
+
+// UUID returns the unique identifier assigned to this tunnel by the server. It is only available
+// after the first instruction is received
+func (t *WebSocketTunnel) UUID() string {
+	return t.uuid
+}
+
+// Connect opens the WebSocket connection. If data is not empty, it is appended to the
+// tunnel url as its query string, the same way guacamole-common-js does
+func (t *WebSocketTunnel) Connect(data string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+	defer cancel()
+	return t.ConnectContext(ctx, data)
+}
+
+// ConnectContext opens the WebSocket connection like Connect, but the dial and the opening
+// handshake are only bounded by the context provided
+func (t *WebSocketTunnel) ConnectContext(ctx context.Context, data string) error {
+	url := t.url
+	if data != "" {
+		url += "?" + data
+	}
+	conn, _, err := t.dialer.DialContext(ctx, url, t.header)
+	if err != nil {
+		return err
+	}
+
+	t.conn = conn
+	t.uuid = ""
+	t.state = TunnelOpen
+	t.io = NewInstructionIO(&webSocketConn{conn: conn})
+	return nil
+}
+
+func (t *WebSocketTunnel) Disconnect() {
+	if t.state == TunnelClosed {
+		return
+	}
+
+	t.state = TunnelClosed
+	_ = t.io.Close()
+}
+
+func (t *WebSocketTunnel) SendInstruction(ins ...*Instruction) error {
+	if t.state != TunnelOpen {
+		return ErrNotConnected
+	}
+
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+
+	for _, in := range ins {
+		if _, err := t.io.Write(in); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReceiveInstruction returns the next instruction sent by the server. Internal instructions
+// are handled by the tunnel itself and are never returned
+func (t *WebSocketTunnel) ReceiveInstruction() (*Instruction, error) {
+	for {
+		if t.state != TunnelOpen {
+			return nil, ErrNotConnected
+		}
+
+		ins, err := t.io.Read()
+		if err != nil {
+			return nil, err
+		}
+		if ins.Opcode != internalDataOpcode {
+			return ins, nil
+		}
+		if err := t.handleInternal(ins); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (t *WebSocketTunnel) handleInternal(ins *Instruction) error {
+	// The first internal instruction sent by the server carries the tunnel UUID. Any other
+	// internal instruction (ex: "ping") is not relevant for this client and is ignored
+	if t.uuid == "" {
+		if len(ins.Args) != 1 {
+			return ErrInvalidUUID
+		}
+		t.uuid = ins.Args[0]
+	}
+	return nil
+}
+
+// webSocketConn adapts a WebSocket connection to an io.ReadWriteCloser, so it can be used
+// with InstructionIO. Each Write is sent as a single text message, and incoming messages are
+// read as a continuous stream of bytes
+type webSocketConn struct {
+	conn   *websocket.Conn
+	reader io.Reader
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			_, r, err := c.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.reader = r
+		}
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	if err := c.conn.WriteMessage(websocket.TextMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *webSocketConn) Close() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	return c.conn.Close()
+}
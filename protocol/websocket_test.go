@@ -0,0 +1,109 @@
+package protocol
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WebSocketTunnel", func() {
+	var (
+		server   *httptest.Server
+		t        *WebSocketTunnel
+		received chan string
+		query    string
+	)
+
+	BeforeEach(func() {
+		received = make(chan string, 10)
+		upgrader := websocket.Upgrader{Subprotocols: []string{"guacamole"}}
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query = r.URL.RawQuery
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_ = conn.WriteMessage(websocket.TextMessage, []byte("0.,36.0b0c42d6-b1d3-4b8f-b1d0-6f3d0f2e1a2b;"))
+			// Two instructions in a single message, followed by one instruction split in two messages
+			_ = conn.WriteMessage(websocket.TextMessage, []byte("4.args,8.hostname;0.,4.ping,13.1590000000000;"))
+			_ = conn.WriteMessage(websocket.TextMessage, []byte("5.ready,"))
+			_ = conn.WriteMessage(websocket.TextMessage, []byte("4.abcd;"))
+			for {
+				_, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				received <- string(msg)
+			}
+		}))
+		t, _ = NewWebSocketTunnel("ws" + strings.TrimPrefix(server.URL, "http"))
+	})
+
+	AfterEach(func() {
+		t.Disconnect()
+		server.Close()
+	})
+
+	It("appends the connection data to the url", func() {
+		Expect(t.Connect("id=123")).To(Succeed())
+		Expect(query).To(Equal("id=123"))
+	})
+
+	It("stops connecting when the context is done", func() {
+		// Accepts the connection, but never completes the opening handshake
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				defer conn.Close()
+				_, _ = io.Copy(ioutil.Discard, conn)
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		t, _ := NewWebSocketTunnel("ws://" + listener.Addr().String())
+		started := time.Now()
+		Expect(t.ConnectContext(ctx, "")).ToNot(Succeed())
+		Expect(time.Since(started)).To(BeNumerically("<", time.Second))
+	})
+
+	It("receives instructions, handling the internal ones", func() {
+		Expect(t.Connect("")).To(Succeed())
+
+		ins, err := t.ReceiveInstruction()
+		Expect(err).To(BeNil())
+		Expect(ins).To(Equal(NewInstruction("args", "hostname")))
+		Expect(t.UUID()).To(Equal("0b0c42d6-b1d3-4b8f-b1d0-6f3d0f2e1a2b"))
+
+		ins, err = t.ReceiveInstruction()
+		Expect(err).To(BeNil())
+		Expect(ins).To(Equal(NewInstruction("ready", "abcd")))
+	})
+
+	It("sends each instruction in a WebSocket message", func() {
+		Expect(t.Connect("")).To(Succeed())
+
+		err := t.SendInstruction(NewInstruction("select", "vnc"), NewInstruction("size", "1024", "768", "96"))
+		Expect(err).To(BeNil())
+		Eventually(received).Should(Receive(Equal("6.select,3.vnc;")))
+		Eventually(received).Should(Receive(Equal("4.size,4.1024,3.768,2.96;")))
+	})
+
+	It("does not send instructions when disconnected", func() {
+		err := t.SendInstruction(NewInstruction("nop"))
+		Expect(err).To(Equal(ErrNotConnected))
+	})
+})
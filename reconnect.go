@@ -0,0 +1,171 @@
+package bring
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/deluan/bring/protocol"
+)
+
+// Opcode of the internal instruction put in the session's input when it is reconnected, signaling
+// the Client to discard all state from the previous connection. It can't clash with any opcode sent
+// by the server, as the empty opcode is reserved for internal use by the tunnels
+const reconnectedOpcode = ""
+
+// Default values used for zero fields of the ReconnectPolicy
+const (
+	defaultReconnectInitialDelay = time.Second
+	defaultReconnectMaxDelay     = 30 * time.Second
+	defaultReconnectMultiplier   = 2.0
+)
+
+// ReconnectPolicy configures how the Client reconnects to the server when the connection is lost.
+// Delays between attempts grow exponentially, starting at InitialDelay and multiplied by Multiplier
+// after each attempt, up to MaxDelay. Jitter is the fraction (0.0 to 1.0) of each delay that will
+// be randomly added or subtracted from it, to avoid multiple clients reconnecting at the same time
+type ReconnectPolicy struct {
+	MaxAttempts  int // Zero or negative means unlimited attempts
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	Jitter       float64
+}
+
+// delay returns the time to wait before the attempt
+func (p *ReconnectPolicy) delay(attempt int) time.Duration {
+	initial, max, multiplier := p.InitialDelay, p.MaxDelay, p.Multiplier
+	if initial <= 0 {
+		initial = defaultReconnectInitialDelay
+	}
+	if max <= 0 {
+		max = defaultReconnectMaxDelay
+	}
+	if multiplier < 1 {
+		multiplier = defaultReconnectMultiplier
+	}
+
+	d := math.Min(float64(initial)*math.Pow(multiplier, float64(attempt-1)), float64(max))
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(d)
+}
+
+func (p *ReconnectPolicy) exhausted(attempt int) bool {
+	return p.MaxAttempts > 0 && attempt > p.MaxAttempts
+}
+
+// ReconnectEvent describes the progress of a reconnection
+type ReconnectEvent struct {
+	// Attempt is the number of the reconnection attempt, starting at 1
+	Attempt int
+	// Err is the error that caused the connection to be lost, or the one that made the previous attempt fail
+	Err error
+	// Reconnected is true when the attempt succeeded and the session is active again
+	Reconnected bool
+}
+
+// OnReconnectFunc is the signature for OnReconnect event handlers
+type OnReconnectFunc = func(event ReconnectEvent)
+
+// WithReconnect enables automatic reconnection, following the policy provided, when the connection
+// with the server is lost after the session was established
+func WithReconnect(policy ReconnectPolicy) Option {
+	return func(o *options) {
+		o.reconnect = &policy
+	}
+}
+
+func (s *session) setOnReconnect(f OnReconnectFunc) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.onReconnect = f
+}
+
+func (s *session) notifyReconnect(event ReconnectEvent) {
+	s.stateMutex.RLock()
+	handler := s.onReconnect
+	s.stateMutex.RUnlock()
+	if handler != nil {
+		handler(event)
+	}
+}
+
+// tryReconnect reconnects to the server, following the session's ReconnectPolicy. It only returns
+// after the connection is reestablished and the handshake started, returning true, or if the session
+// should be terminated (no policy, attempts exhausted or closed session), returning false. Sessions
+// ended by the server (with "disconnect" or "error") are terminated by the reader, and never reconnected
+func (s *session) tryReconnect(cause error) bool {
+	if s.reconnect == nil {
+		return false
+	}
+	// Only reconnect sessions that were established before, or that are reconnecting
+	if s.getState() != SessionActive && s.attempt == 0 {
+		return false
+	}
+	if s.terminated() {
+		return false
+	}
+
+	s.getTunnel().Disconnect()
+	s.setState(SessionHandshake)
+	for {
+		s.attempt++
+		if s.reconnect.exhausted(s.attempt) {
+			s.logger.Errorf("Giving up reconnecting after %d attempts", s.attempt-1)
+			return false
+		}
+
+		s.notifyReconnect(ReconnectEvent{Attempt: s.attempt, Err: cause})
+		delay := s.reconnect.delay(s.attempt)
+		s.logger.Warnf("Connection lost (%s). Reconnecting in %s (attempt %d)", cause, delay, s.attempt)
+		select {
+		case <-time.After(delay):
+		case <-s.done:
+			return false
+		}
+
+		ctx, cancel := s.attemptContext()
+		err := s.connect(ctx)
+		cancel()
+		if err == nil {
+			break
+		}
+		if s.terminated() {
+			return false
+		}
+		cause = err
+	}
+
+	// The session could have been closed after connecting. Its new tunnel is disconnected by terminate
+	return !s.terminated()
+}
+
+// attemptContext returns the context of a reconnection attempt, which expires after defaultHandshakeTimeout
+// or when the session is terminated, so closing the session does not wait for a slow connection
+func (s *session) attemptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultHandshakeTimeout)
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// reconnected is called when the handshake completes. If it was a reconnection, it notifies the Client
+// (through the In channel, so the notification is processed after all pending instructions) and the
+// OnReconnect handler
+func (s *session) reconnected() {
+	if s.attempt == 0 {
+		return
+	}
+	s.logger.Infof("Reconnected after %d attempt(s)", s.attempt)
+	s.deliver(protocol.NewInstruction(reconnectedOpcode))
+	s.notifyReconnect(ReconnectEvent{Attempt: s.attempt, Reconnected: true})
+	s.attempt = 0
+}
@@ -0,0 +1,213 @@
+package bring
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/deluan/bring/protocol"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ReconnectPolicy", func() {
+	It("grows the delay exponentially", func() {
+		p := &ReconnectPolicy{InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: 3}
+		Expect(p.delay(1)).To(Equal(time.Second))
+		Expect(p.delay(2)).To(Equal(3 * time.Second))
+		Expect(p.delay(3)).To(Equal(9 * time.Second))
+		Expect(p.delay(10)).To(Equal(time.Minute))
+	})
+
+	It("uses defaults for zero values", func() {
+		p := &ReconnectPolicy{}
+		Expect(p.delay(1)).To(Equal(defaultReconnectInitialDelay))
+		Expect(p.delay(2)).To(Equal(2 * defaultReconnectInitialDelay))
+		Expect(p.delay(100)).To(Equal(defaultReconnectMaxDelay))
+		Expect(p.exhausted(1000)).To(BeFalse())
+	})
+
+	It("adds jitter to the delay", func() {
+		p := &ReconnectPolicy{InitialDelay: time.Second, Jitter: 0.5}
+		for i := 0; i < 100; i++ {
+			Expect(p.delay(1)).To(BeNumerically("~", time.Second, 500*time.Millisecond))
+		}
+	})
+
+	It("limits the number of attempts", func() {
+		p := &ReconnectPolicy{MaxAttempts: 3}
+		Expect(p.exhausted(3)).To(BeFalse())
+		Expect(p.exhausted(4)).To(BeTrue())
+	})
+})
+
+var _ = Describe("Session reconnection", func() {
+	var (
+		server *fakeServer
+		events chan ReconnectEvent
+		s      *session
+	)
+
+	BeforeEach(func() {
+		server = &fakeServer{
+			replies: map[string]string{
+				"select":  "4.args,8.hostname;",
+				"connect": "5.ready,21.$unique-connection-id;",
+			},
+		}
+		events = make(chan ReconnectEvent, 10)
+		t, _ := protocol.NewInetSocketTunnel(server.start())
+		var err error
+		s, err = newSession(context.Background(), "vnc", nil, testOptions(
+			WithTunnel(t),
+			WithReconnect(ReconnectPolicy{InitialDelay: 10 * time.Millisecond}),
+		))
+		Expect(err).To(BeNil())
+		s.setOnReconnect(func(event ReconnectEvent) {
+			events <- event
+		})
+	})
+
+	AfterEach(func() {
+		s.Terminate()
+	})
+
+	It("reconnects when the connection is lost", func() {
+		Expect(s.Send(protocol.NewInstruction(dropOpcode))).To(Succeed())
+
+		var event ReconnectEvent
+		Eventually(events).Should(Receive(&event))
+		Expect(event.Attempt).To(Equal(1))
+		Expect(event.Reconnected).To(BeFalse())
+		Expect(event.Err).ToNot(BeNil())
+
+		Eventually(events).Should(Receive(&event))
+		Expect(event).To(Equal(ReconnectEvent{Attempt: 1, Reconnected: true}))
+		Expect(s.getState()).To(Equal(SessionActive))
+
+		Eventually(s.In).Should(Receive(Equal(protocol.NewInstruction(reconnectedOpcode))))
+		Expect(s.done).ToNot(BeClosed())
+	})
+
+	It("does not reconnect when the server ends the session", func() {
+		// Makes the fake server send "disconnect" and close the connection
+		Expect(s.Send(protocol.NewInstruction(disconnectOpcode))).To(Succeed())
+
+		Eventually(s.done).Should(BeClosed())
+		Expect(s.err).To(BeNil())
+		Consistently(events, "100ms").ShouldNot(Receive())
+	})
+})
+
+var _ = Describe("Session closed while reconnecting", func() {
+	It("stays closed, disconnecting the new tunnel", func() {
+		server := &fakeServer{
+			replies: map[string]string{
+				"select":  "4.args,8.hostname;",
+				"connect": "5.ready,21.$unique-connection-id;",
+			},
+		}
+		addr := server.start()
+		dialing, release := make(chan struct{}), make(chan struct{})
+		tunnels := make(chan *recordingTunnel, 1)
+		dials := 0
+		dialer := func() (protocol.Tunnel, error) {
+			dials++
+			t, err := protocol.NewInetSocketTunnel(addr)
+			if dials == 1 {
+				return t, err
+			}
+			// Only the first reconnection attempt is expected, as the session is closed during it
+			close(dialing)
+			<-release
+			rt := &recordingTunnel{Tunnel: t, disconnected: make(chan struct{})}
+			tunnels <- rt
+			return rt, err
+		}
+
+		s, err := newSession(context.Background(), "vnc", nil, testOptions(
+			WithDialer(dialer),
+			WithReconnect(ReconnectPolicy{InitialDelay: 10 * time.Millisecond}),
+		))
+		Expect(err).To(BeNil())
+		var mutex sync.Mutex
+		var states []SessionState
+		s.setOnStateChange(func(state, previous SessionState) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			states = append(states, state)
+		})
+
+		Expect(s.Send(protocol.NewInstruction(dropOpcode))).To(Succeed())
+		Eventually(dialing).Should(BeClosed())
+		s.Terminate()
+		close(release)
+
+		var newTunnel *recordingTunnel
+		Eventually(tunnels).Should(Receive(&newTunnel))
+		Eventually(newTunnel.disconnected).Should(BeClosed())
+		Eventually(s.In).Should(BeClosed())
+		Expect(s.getState()).To(Equal(SessionClosed))
+		mutex.Lock()
+		defer mutex.Unlock()
+		Expect(states).To(Equal([]SessionState{SessionHandshake, SessionClosed}))
+	})
+
+	It("cancels the connection attempt in progress", func() {
+		server := &fakeServer{
+			replies: map[string]string{
+				"select":  "4.args,8.hostname;",
+				"connect": "5.ready,21.$unique-connection-id;",
+			},
+		}
+		addr := server.start()
+		connecting := &connectingTunnel{started: make(chan struct{}), cancelled: make(chan struct{})}
+		dials := 0
+		dialer := func() (protocol.Tunnel, error) {
+			dials++
+			if dials == 1 {
+				return protocol.NewInetSocketTunnel(addr)
+			}
+			return connecting, nil
+		}
+
+		s, err := newSession(context.Background(), "vnc", nil, testOptions(
+			WithDialer(dialer),
+			WithReconnect(ReconnectPolicy{InitialDelay: 10 * time.Millisecond}),
+		))
+		Expect(err).To(BeNil())
+
+		Expect(s.Send(protocol.NewInstruction(dropOpcode))).To(Succeed())
+		Eventually(connecting.started).Should(BeClosed())
+		s.Terminate()
+
+		Eventually(connecting.cancelled).Should(BeClosed())
+		Eventually(s.In).Should(BeClosed())
+	})
+})
+
+// connectingTunnel never connects, until the context of the connection attempt is done
+type connectingTunnel struct {
+	mockTunnel
+	started   chan struct{}
+	cancelled chan struct{}
+}
+
+func (ct *connectingTunnel) ConnectContext(ctx context.Context, _ string) error {
+	close(ct.started)
+	<-ctx.Done()
+	close(ct.cancelled)
+	return ctx.Err()
+}
+
+// recordingTunnel signals when it is disconnected
+type recordingTunnel struct {
+	protocol.Tunnel
+	once         sync.Once
+	disconnected chan struct{}
+}
+
+func (t *recordingTunnel) Disconnect() {
+	t.Tunnel.Disconnect()
+	t.once.Do(func() { close(t.disconnected) })
+}
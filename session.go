@@ -1,16 +1,20 @@
 package bring
 
 import (
+	"context"
 	"errors"
 	_ "golang.org/x/image/webp"
 	_ "image/jpeg"
 	_ "image/png"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/deluan/bring/protocol"
 )
 
+// SessionState represents the state of the connection with the server
 type SessionState int
 
 const (
@@ -19,75 +23,260 @@ const (
 	SessionActive
 )
 
+var sessionStateNames = map[SessionState]string{
+	SessionClosed:    "Closed",
+	SessionHandshake: "Handshake",
+	SessionActive:    "Active",
+}
+
+func (s SessionState) String() string {
+	if name, ok := sessionStateNames[s]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
 const (
-	defaultWidth  = "1024"
-	defaultHeight = "768"
+	defaultWidth  = 1024
+	defaultHeight = 768
 )
 
+// Connection parameter used by guacd to restrict users to only observe the connection
+const readOnlyArg = "read-only"
+
 var ErrNotConnected = errors.New("not connected")
 
 const pingFrequency = 5 * time.Second
 
 // Session is used to create and keep a connection with a guacd server,
 // and it is responsible for the initial handshake and to send and receive instructions.
-// Instructions received are put in the In channel. Instructions are sent using the Send() function
+// Instructions received are put in the In channel, which is closed when the session terminates.
+// Instructions are sent using the Send() function
 type session struct {
-	In    chan *protocol.Instruction
-	State SessionState
-	Id    string
+	In chan *protocol.Instruction
+	Id string
 
-	tunnel   protocol.Tunnel
-	logger   Logger
-	done     chan bool
-	config   map[string]string
-	protocol string
+	logger    Logger
+	dialer    Dialer
+	done      chan struct{}
+	ready     chan struct{}
+	closeOnce sync.Once
+	err       error
+	config    map[string]string
+	protocol  string
+	joinId    string
+	readOnly  bool
+	handshake handshakeOptions
+	version   protocol.Version
+
+	sizeMutex sync.Mutex
+	width     int
+	height    int
+	dpi       int
+
+	tunnelMutex sync.RWMutex
+	tunnel      protocol.Tunnel
+
+	keepAliveOnce sync.Once
+	reconnect     *ReconnectPolicy
+	attempt       int
+	onReconnect   OnReconnectFunc
+
+	stateMutex    sync.RWMutex
+	state         SessionState
+	onStateChange OnStateChangeFunc
 }
 
-// newSession creates a new connection with the guacd server, using the configuration provided
-func newSession(addr string, remoteProtocol string, config map[string]string, logger Logger) (*session, error) {
-	t, err := protocol.NewInetSocketTunnel(addr)
+// newSession creates a new connection with the guacd server, through the tunnel created by the dialer and using
+// the configuration provided. It only returns after the handshake is completed, failed or the context is done
+func newSession(ctx context.Context, remoteProtocol string, config map[string]string, o *options) (*session, error) {
+	s := &session{
+		In:        make(chan *protocol.Instruction, 100),
+		done:      make(chan struct{}),
+		ready:     make(chan struct{}),
+		logger:    o.logger,
+		dialer:    o.dialer,
+		reconnect: o.reconnect,
+		config:    config,
+		protocol:  remoteProtocol,
+		joinId:    o.connectionID,
+		readOnly:  o.readOnly,
+		handshake: o.handshake,
+
+		onStateChange: o.onStateChange,
+	}
+
+	s.width, s.height, s.dpi = parseInt(config["width"]), parseInt(config["height"]), o.handshake.dpi
+	if s.width <= 0 || s.height <= 0 {
+		s.width, s.height = defaultWidth, defaultHeight
+	}
+
+	err := s.connect(ctx)
 	if err != nil {
 		return nil, err
 	}
+	s.startReader()
 
-	err = t.Connect("")
+	select {
+	case <-s.ready:
+		return s, nil
+	case <-s.done:
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, ErrNotConnected
+	case <-ctx.Done():
+		s.logger.Errorf("Handshake not completed: %s", ctx.Err())
+		s.terminate(ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+// connect creates a new tunnel and initiates the handshake, which is completed by the reader
+func (s *session) connect(ctx context.Context) error {
+	t, err := s.dialer()
 	if err != nil {
-		logger.Errorf("Error connecting to '%s': %s", addr, err)
-		return nil, err
+		return err
 	}
 
-	s := &session{
-		In:       make(chan *protocol.Instruction, 100),
-		State:    SessionClosed,
-		done:     make(chan bool),
-		logger:   logger,
-		tunnel:   t,
-		config:   config,
-		protocol: remoteProtocol,
+	err = protocol.Connect(ctx, t, "")
+	if err != nil {
+		s.logger.Errorf("Error connecting to server: %s", err)
+		return err
+	}
+	if !s.replaceTunnel(t) {
+		s.logger.Warnf("Session closed while connecting to server")
+		t.Disconnect()
+		return ErrNotConnected
 	}
 
-	s.logger.Infof("Initiating %s session with %s", strings.ToUpper(remoteProtocol), addr)
-	err = s.Send(protocol.NewInstruction("select", remoteProtocol))
+	selectArg := s.protocol
+	if s.joinId != "" {
+		selectArg = s.joinId
+		s.logger.Infof("Joining connection %s", s.joinId)
+	} else {
+		s.logger.Infof("Initiating %s session", strings.ToUpper(s.protocol))
+	}
+	err = s.Send(protocol.NewInstruction("select", selectArg))
 	if err != nil {
 		s.logger.Errorf("Failed sending 'select': %s", err)
-		return nil, err
+		t.Disconnect()
+		return err
 	}
 
-	s.State = SessionHandshake
-	s.startReader()
-
-	return s, nil
+	s.setState(SessionHandshake)
+	return nil
 }
 
 // Terminate the current session, disconnecting from the server
 func (s *session) Terminate() {
-	if s.State == SessionClosed {
+	s.terminate(nil)
+}
+
+// terminate the current session, recording the reason. A nil err means the session was closed normally
+func (s *session) terminate(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		s.setState(SessionClosed)
+		t := s.getTunnel()
+		_ = t.SendInstruction(protocol.NewInstruction("disconnect"))
+		t.Disconnect()
+	})
+}
+
+func (s *session) getTunnel() protocol.Tunnel {
+	s.tunnelMutex.RLock()
+	defer s.tunnelMutex.RUnlock()
+	return s.tunnel
+}
+
+func (s *session) setTunnel(t protocol.Tunnel) {
+	s.tunnelMutex.Lock()
+	defer s.tunnelMutex.Unlock()
+	s.tunnel = t
+}
+
+// replaceTunnel makes the session use the new tunnel, unless the session was terminated. The check is
+// done holding the state lock, so terminate, which changes the state before disconnecting the
+// current tunnel, always disconnects the new one if it runs concurrently
+func (s *session) replaceTunnel(t protocol.Tunnel) bool {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	if s.terminated() {
+		return false
+	}
+	s.setTunnel(t)
+	return true
+}
+
+// terminated returns true if the session was terminated, and can't be used anymore
+func (s *session) terminated() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// getState returns the current state of the session. It is safe to be called from any goroutine
+func (s *session) getState() SessionState {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	return s.state
+}
+
+// setState changes the state of the session, notifying the state change handler if the new state
+// is different from the current one. A terminated session stays closed
+func (s *session) setState(state SessionState) {
+	s.stateMutex.Lock()
+	previous := s.state
+	if previous == SessionClosed && s.terminated() {
+		s.stateMutex.Unlock()
 		return
 	}
-	close(s.done)
-	s.State = SessionClosed
-	_ = s.tunnel.SendInstruction(protocol.NewInstruction("disconnect"))
-	s.tunnel.Disconnect()
+	s.state = state
+	handler := s.onStateChange
+	s.stateMutex.Unlock()
+
+	if handler != nil && previous != state {
+		handler(state, previous)
+	}
+}
+
+// connectionID returns the ID of the connection with the remote server, as sent by the server at the
+// end of the handshake. It is safe to be called from any goroutine
+func (s *session) connectionID() string {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	return s.Id
+}
+
+func (s *session) setConnectionID(id string) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.Id = id
+}
+
+// getVersion returns the protocol version negotiated in the last handshake. It is safe to be called
+// from any goroutine
+func (s *session) getVersion() protocol.Version {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	return s.version
+}
+
+func (s *session) setVersion(version protocol.Version) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.version = version
+}
+
+func (s *session) setOnStateChange(f OnStateChangeFunc) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.onStateChange = f
 }
 
 // Send instructions to the server. Multiple instructions are sent in one single transaction
@@ -95,10 +284,14 @@ func (s *session) Send(ins ...*protocol.Instruction) error {
 	for _, i := range ins {
 		s.logger.Debugf("C> %s", i)
 	}
-	return s.tunnel.SendInstruction(ins...)
+	return s.getTunnel().SendInstruction(ins...)
 }
 
 func (s *session) startKeepAlive() {
+	s.keepAliveOnce.Do(s.keepAlive)
+}
+
+func (s *session) keepAlive() {
 	go func() {
 		ping := time.NewTicker(pingFrequency)
 		defer ping.Stop()
@@ -118,12 +311,16 @@ func (s *session) startKeepAlive() {
 
 func (s *session) startReader() {
 	go func() {
+		defer close(s.In)
 		for {
-			ins, err := s.tunnel.ReceiveInstruction()
+			ins, err := s.getTunnel().ReceiveInstruction()
 			if err != nil {
+				if s.tryReconnect(err) {
+					continue
+				}
 				s.logger.Warnf("Disconnecting from server. Reason: " + err.Error())
-				s.Terminate()
-				break
+				s.terminate(err)
+				return
 			}
 			if ins.Opcode == "blob" {
 				s.logger.Debugf("S> 4.blob: %d", len(ins.Args[1]))
@@ -134,19 +331,49 @@ func (s *session) startReader() {
 				continue
 			}
 			if ins.Opcode == "ready" {
-				s.State = SessionActive
-				s.Id = ins.Args[0]
-				s.logger.Infof("Handshake successful. Got connection ID %s", s.Id)
+				s.setConnectionID(ins.Args[0])
+				s.setState(SessionActive)
+				s.logger.Infof("Handshake successful. Got connection ID %s", ins.Args[0])
 				s.startKeepAlive()
+				s.reconnected()
+				s.markReady()
 				continue
 			}
-			if s.State == SessionHandshake {
+			if s.getState() == SessionHandshake && ins.Opcode == "error" {
+				err := newServerError(ins.Args)
+				s.logger.Errorf("Handshake failed: %s", err)
+				if s.tryReconnect(err) {
+					continue
+				}
+				s.terminate(err)
+				return
+			}
+			if s.getState() == SessionHandshake {
 				s.logger.Infof("Handshake started at %s", time.Now().Format(time.RFC3339))
-				s.handShake(ins)
+				if err := s.handShake(ins); err != nil {
+					if s.tryReconnect(err) {
+						continue
+					}
+					s.terminate(err)
+					return
+				}
 				continue
 			}
-			if s.State == SessionActive {
-				s.In <- ins
+			if s.getState() == SessionActive && (ins.Opcode == "error" || ins.Opcode == "disconnect") {
+				// The server closes the connection right after ending the session. The session is
+				// terminated with the reason sent, before the connection is found to be closed
+				var reason error
+				if ins.Opcode == "error" {
+					reason = newServerError(ins.Args)
+				}
+				s.deliver(ins)
+				s.terminate(reason)
+				return
+			}
+			if s.getState() == SessionActive {
+				if !s.deliver(ins) {
+					return
+				}
 				continue
 			}
 			s.logger.Warnf("Received out of order instruction: %s", ins)
@@ -154,36 +381,95 @@ func (s *session) startReader() {
 	}()
 }
 
-func (s *session) handShake(argsIns *protocol.Instruction) {
-	width := s.config["width"]
-	if width == "" {
-		width = defaultWidth
+// deliver the instruction to the In channel. Returns false if the session was terminated
+func (s *session) deliver(ins *protocol.Instruction) bool {
+	select {
+	case s.In <- ins:
+		return true
+	case <-s.done:
+		return false
 	}
-	height := s.config["height"]
-	if height == "" {
-		height = defaultHeight
+}
+
+func (s *session) markReady() {
+	select {
+	case <-s.ready:
+	default:
+		close(s.ready)
 	}
+}
+
+// resize requests the server to change the display size. If dpi is not positive, the current DPI is kept.
+// The new size is kept, so it is requested again if the session reconnects
+func (s *session) resize(width, height, dpi int) error {
+	s.sizeMutex.Lock()
+	s.width, s.height = width, height
+	if dpi > 0 {
+		s.dpi = dpi
+	}
+	s.sizeMutex.Unlock()
+	return s.Send(s.sizeInstruction())
+}
+
+func (s *session) sizeInstruction() *protocol.Instruction {
+	s.sizeMutex.Lock()
+	defer s.sizeMutex.Unlock()
+	return protocol.NewInstruction("size", strconv.Itoa(s.width), strconv.Itoa(s.height), strconv.Itoa(s.dpi))
+}
+
+// handShake responds to the "args" instruction, sending the client capabilities and the values of all
+// arguments requested. If the server reports its protocol version, the lowest common version is used
+func (s *session) handShake(argsIns *protocol.Instruction) error {
+	args := argsIns.Args
+	versioned := false
+	version := protocol.Version100
+	if len(args) > 0 {
+		var v protocol.Version
+		if v, versioned = protocol.ParseVersion(args[0]); versioned {
+			version = v
+			if v.AtLeast(protocol.LatestVersion) {
+				version = protocol.LatestVersion
+			}
+		}
+	}
+	s.setVersion(version)
+
+	h := s.handshake
 	options := []*protocol.Instruction{
-		protocol.NewInstruction("size", width, height, "96"),
-		protocol.NewInstruction("audio"),
-		protocol.NewInstruction("video"),
-		protocol.NewInstruction("image", "image/png", "image/jpeg", "image/webp"),
+		s.sizeInstruction(),
+		protocol.NewInstruction("audio", h.audioMimetypes...),
+		protocol.NewInstruction("video", h.videoMimetypes...),
+		protocol.NewInstruction("image", h.imageMimetypes...),
+	}
+	if h.timezone != "" && version.AtLeast(protocol.Version110) {
+		options = append(options, protocol.NewInstruction("timezone", h.timezone))
+	}
+	if h.name != "" && version.AtLeast(protocol.Version150) {
+		options = append(options, protocol.NewInstruction("name", h.name))
 	}
 
 	err := s.Send(options...)
 	if err != nil {
 		s.logger.Errorf("Failed handshake: %s", err)
-		s.Terminate()
+		return err
 	}
 
-	connectValues := make([]string, len(argsIns.Args))
-	for i, argName := range argsIns.Args {
+	connectValues := make([]string, len(args))
+	for i, argName := range args {
+		if i == 0 && versioned {
+			connectValues[i] = version.String()
+			continue
+		}
 		connectValues[i] = s.config[argName]
+		// Read-only applies to users joining a connection, not to the owner of a new one
+		if argName == readOnlyArg && s.readOnly && s.joinId != "" {
+			connectValues[i] = "true"
+		}
 	}
 
 	err = s.Send(protocol.NewInstruction("connect", connectValues...))
 	if err != nil {
 		s.logger.Errorf("Failed handshake when sending 'connect': %s", err)
-		s.Terminate()
 	}
+	return err
 }
@@ -1,6 +1,8 @@
 package bring
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/deluan/bring/protocol"
@@ -20,15 +22,15 @@ var _ = Describe("Session", func() {
 				"connect": "5.ready,21.$unique-connection-id;",
 			},
 		}
-		addr := server.start()
-		s, _ = newSession(addr, "rdp", map[string]string{
+		t, _ := protocol.NewInetSocketTunnel(server.start())
+		s, _ = newSession(context.Background(), "rdp", map[string]string{
 			"hostname": "host1",
 			"port":     "port1",
 			"password": "password123",
-		}, &DefaultLogger{Quiet: true})
+		}, testOptions(WithTunnel(t)))
 
 		Eventually(func() SessionState {
-			return s.State
+			return s.getState()
 		}, 3*time.Second, 100*time.Millisecond).Should(Equal(SessionActive))
 	})
 
@@ -41,4 +43,158 @@ var _ = Describe("Session", func() {
 		Expect(server.messagesReceived[len(server.messagesReceived)-1]).To(Equal("7.connect,5.host1,5.port1,11.password123;"))
 		Expect(s.Id).To(Equal("$unique-connection-id"))
 	})
+
+	It("closes the input channel when the server disconnects", func() {
+		err := s.Send(protocol.NewInstruction(disconnectOpcode))
+		Expect(err).To(BeNil())
+
+		Eventually(s.done).Should(BeClosed())
+		Eventually(s.In).Should(BeClosed())
+		Expect(s.getState()).To(Equal(SessionClosed))
+	})
 })
+
+var _ = Describe("Session handshake", func() {
+	It("negotiates the protocol version and sends all client information", func() {
+		server := &fakeServer{
+			replies: map[string]string{
+				"select":  "4.args,13.VERSION_1_9_0,8.hostname;",
+				"connect": "5.ready,21.$unique-connection-id;",
+			},
+		}
+		t, _ := protocol.NewInetSocketTunnel(server.start())
+
+		s, err := newSession(context.Background(), "vnc", map[string]string{"hostname": "host1", "width": "800", "height": "600"},
+			testOptions(WithTunnel(t), WithDPI(120), WithTimezone("America/Sao_Paulo"), WithName("bring"),
+				WithAudioMimetypes("audio/L16"), WithImageMimetypes("image/png")))
+		Expect(err).To(BeNil())
+		Expect(s.getVersion()).To(Equal(protocol.LatestVersion))
+
+		Expect(s.Send(protocol.NewInstruction(disconnectOpcode))).To(Succeed())
+		Eventually(s.done).Should(BeClosed())
+		Expect(server.messagesReceived[1:]).To(Equal([]string{
+			"4.size,3.800,3.600,3.120;",
+			"5.audio,9.audio/L16;",
+			"5.video;",
+			"5.image,9.image/png;",
+			"8.timezone,17.America/Sao_Paulo;",
+			"4.name,5.bring;",
+			"7.connect,13.VERSION_1_5_0,5.host1;",
+		}))
+	})
+
+	It("does not send instructions not supported by older servers", func() {
+		server := &fakeServer{
+			replies: map[string]string{
+				"select":  "4.args,13.VERSION_1_1_0,8.hostname;",
+				"connect": "5.ready,21.$unique-connection-id;",
+			},
+		}
+		t, _ := protocol.NewInetSocketTunnel(server.start())
+
+		s, err := newSession(context.Background(), "vnc", map[string]string{"hostname": "host1"},
+			testOptions(WithTunnel(t), WithTimezone("UTC"), WithName("bring")))
+		Expect(err).To(BeNil())
+		Expect(s.getVersion()).To(Equal(protocol.Version110))
+
+		Expect(s.Send(protocol.NewInstruction(disconnectOpcode))).To(Succeed())
+		Eventually(s.done).Should(BeClosed())
+		Expect(server.opcodesReceived).To(Equal([]string{"select", "size", "audio", "video", "image", "timezone", "connect"}))
+		Expect(server.messagesReceived[len(server.messagesReceived)-1]).To(Equal("7.connect,13.VERSION_1_1_0,5.host1;"))
+	})
+
+	It("joins an existing connection as a read-only user", func() {
+		server := &fakeServer{
+			replies: map[string]string{
+				"select":  "4.args,8.hostname,9.read-only;",
+				"connect": "5.ready,21.$unique-connection-id;",
+			},
+		}
+		t, _ := protocol.NewInetSocketTunnel(server.start())
+
+		s, err := newSession(context.Background(), "vnc", map[string]string{"hostname": "host1"},
+			testOptions(WithTunnel(t), WithJoin("$unique-connection-id"), WithReadOnly()))
+		Expect(err).To(BeNil())
+		Expect(s.connectionID()).To(Equal("$unique-connection-id"))
+
+		Expect(s.Send(protocol.NewInstruction(disconnectOpcode))).To(Succeed())
+		Eventually(s.done).Should(BeClosed())
+		Expect(server.messagesReceived[0]).To(Equal("6.select,21.$unique-connection-id;"))
+		Expect(server.messagesReceived[len(server.messagesReceived)-1]).To(Equal("7.connect,5.host1,4.true;"))
+	})
+
+	It("ignores read-only when not joining a connection", func() {
+		server := &fakeServer{
+			replies: map[string]string{
+				"select":  "4.args,8.hostname,9.read-only;",
+				"connect": "5.ready,21.$unique-connection-id;",
+			},
+		}
+		t, _ := protocol.NewInetSocketTunnel(server.start())
+
+		s, err := newSession(context.Background(), "vnc", map[string]string{"hostname": "host1"},
+			testOptions(WithTunnel(t), WithReadOnly()))
+		Expect(err).To(BeNil())
+
+		Expect(s.Send(protocol.NewInstruction(disconnectOpcode))).To(Succeed())
+		Eventually(s.done).Should(BeClosed())
+		Expect(server.messagesReceived[len(server.messagesReceived)-1]).To(Equal("7.connect,5.host1,0.;"))
+	})
+
+	It("notifies the state changes while connecting", func() {
+		server := &fakeServer{
+			replies: map[string]string{
+				"select":  "4.args,8.hostname;",
+				"connect": "5.ready,21.$unique-connection-id;",
+			},
+		}
+		t, _ := protocol.NewInetSocketTunnel(server.start())
+		var mutex sync.Mutex
+		var states []SessionState
+		onStateChange := func(state, previous SessionState) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			states = append(states, state)
+		}
+
+		s, err := newSession(context.Background(), "vnc", nil, testOptions(WithTunnel(t), WithStateChange(onStateChange)))
+		Expect(err).To(BeNil())
+		defer s.Terminate()
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		Expect(states).To(Equal([]SessionState{SessionHandshake, SessionActive}))
+	})
+
+	It("aborts the handshake when the context expires", func() {
+		server := &fakeServer{
+			replies: map[string]string{
+				"select": "4.args,8.hostname;",
+			},
+		}
+		t, _ := protocol.NewInetSocketTunnel(server.start())
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		s, err := newSession(ctx, "vnc", nil, testOptions(WithTunnel(t)))
+		Expect(err).To(Equal(context.DeadlineExceeded))
+		Expect(s).To(BeNil())
+	})
+
+	It("returns the error sent by the server", func() {
+		server := &fakeServer{
+			replies: map[string]string{
+				"select": "5.error,14.Host not found,3.519;",
+			},
+		}
+		t, _ := protocol.NewInetSocketTunnel(server.start())
+
+		s, err := newSession(context.Background(), "vnc", nil, testOptions(WithTunnel(t)))
+		Expect(err).To(Equal(&ServerError{Status: StatusUpstreamNotFound, Message: "Host not found"}))
+		Expect(s).To(BeNil())
+	})
+})
+
+func testOptions(opts ...Option) *options {
+	return newOptions(append([]Option{WithLogger(&DefaultLogger{Quiet: true})}, opts...))
+}
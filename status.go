@@ -0,0 +1,107 @@
+package bring
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// StatusCode represents the status codes sent by the server in "error" and "ack" instructions
+type StatusCode int
+
+// All status codes defined by the Guacamole protocol
+const (
+	StatusSuccess             StatusCode = 0x0000
+	StatusUnsupported         StatusCode = 0x0100
+	StatusServerError         StatusCode = 0x0200
+	StatusServerBusy          StatusCode = 0x0201
+	StatusUpstreamTimeout     StatusCode = 0x0202
+	StatusUpstreamError       StatusCode = 0x0203
+	StatusResourceNotFound    StatusCode = 0x0204
+	StatusResourceConflict    StatusCode = 0x0205
+	StatusResourceClosed      StatusCode = 0x0206
+	StatusUpstreamNotFound    StatusCode = 0x0207
+	StatusUpstreamUnavailable StatusCode = 0x0208
+	StatusSessionConflict     StatusCode = 0x0209
+	StatusSessionTimeout      StatusCode = 0x020A
+	StatusSessionClosed       StatusCode = 0x020B
+	StatusClientBadRequest    StatusCode = 0x0300
+	StatusClientUnauthorized  StatusCode = 0x0301
+	StatusClientForbidden     StatusCode = 0x0303
+	StatusClientTimeout       StatusCode = 0x0308
+	StatusClientOverrun       StatusCode = 0x030D
+	StatusClientBadType       StatusCode = 0x030F
+	StatusClientTooMany       StatusCode = 0x031D
+)
+
+var statusNames = map[StatusCode]string{
+	StatusSuccess:             "SUCCESS",
+	StatusUnsupported:         "UNSUPPORTED",
+	StatusServerError:         "SERVER_ERROR",
+	StatusServerBusy:          "SERVER_BUSY",
+	StatusUpstreamTimeout:     "UPSTREAM_TIMEOUT",
+	StatusUpstreamError:       "UPSTREAM_ERROR",
+	StatusResourceNotFound:    "RESOURCE_NOT_FOUND",
+	StatusResourceConflict:    "RESOURCE_CONFLICT",
+	StatusResourceClosed:      "RESOURCE_CLOSED",
+	StatusUpstreamNotFound:    "UPSTREAM_NOT_FOUND",
+	StatusUpstreamUnavailable: "UPSTREAM_UNAVAILABLE",
+	StatusSessionConflict:     "SESSION_CONFLICT",
+	StatusSessionTimeout:      "SESSION_TIMEOUT",
+	StatusSessionClosed:       "SESSION_CLOSED",
+	StatusClientBadRequest:    "CLIENT_BAD_REQUEST",
+	StatusClientUnauthorized:  "CLIENT_UNAUTHORIZED",
+	StatusClientForbidden:     "CLIENT_FORBIDDEN",
+	StatusClientTimeout:       "CLIENT_TIMEOUT",
+	StatusClientOverrun:       "CLIENT_OVERRUN",
+	StatusClientBadType:       "CLIENT_BAD_TYPE",
+	StatusClientTooMany:       "CLIENT_TOO_MANY",
+}
+
+func (c StatusCode) String() string {
+	if name, ok := statusNames[c]; ok {
+		return name
+	}
+	return "0x" + strconv.FormatInt(int64(c), 16)
+}
+
+// IsError returns true if the status code represents an error. All codes outside the
+// range 0x0000-0x00FF are errors
+func (c StatusCode) IsError() bool {
+	return c < 0 || c > 0x00FF
+}
+
+// ServerError is the error reported by the server with an "error" instruction. The Status
+// can be used to find out the cause of the error (ex: StatusClientUnauthorized for bad credentials
+// or StatusUpstreamNotFound for an unreachable host)
+type ServerError struct {
+	Status  StatusCode
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error %s: %s", e.Status, e.Message)
+}
+
+// StreamError is the error reported by the server, with an "ack" instruction, for a stream sent by the Client
+// (ex: StatusClientForbidden when uploading a file to a read-only drive)
+type StreamError struct {
+	Index   int
+	Status  StatusCode
+	Message string
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("stream %d error %s: %s", e.Index, e.Status, e.Message)
+}
+
+// newServerError creates a ServerError from the arguments of an "error" instruction
+func newServerError(args []string) *ServerError {
+	err := &ServerError{Status: StatusServerError}
+	if len(args) > 0 {
+		err.Message = args[0]
+	}
+	if len(args) > 1 {
+		err.Status = StatusCode(parseInt(args[1]))
+	}
+	return err
+}
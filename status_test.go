@@ -0,0 +1,29 @@
+package bring
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("StatusCode", func() {
+	It("identifies error codes", func() {
+		Expect(StatusSuccess.IsError()).To(BeFalse())
+		Expect(StatusCode(0x00FF).IsError()).To(BeFalse())
+		Expect(StatusUnsupported.IsError()).To(BeTrue())
+		Expect(StatusClientTooMany.IsError()).To(BeTrue())
+	})
+
+	It("has a readable representation", func() {
+		Expect(StatusUpstreamTimeout.String()).To(Equal("UPSTREAM_TIMEOUT"))
+		Expect(StatusCode(0x0999).String()).To(Equal("0x999"))
+	})
+})
+
+var _ = Describe("ServerError", func() {
+	It("is created from the error instruction arguments", func() {
+		err := newServerError([]string{"Login failed", "769"})
+		Expect(err.Status).To(Equal(StatusClientUnauthorized))
+		Expect(err.Message).To(Equal("Login failed"))
+		Expect(err.Error()).To(Equal("server error CLIENT_UNAUTHORIZED: Login failed"))
+	})
+})
@@ -3,14 +3,38 @@ package bring
 import (
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"image"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/deluan/bring/protocol"
 )
 
+// Maximum number of bytes sent in a single blob. When base64 encoded, it fits in the maximum
+// instruction length accepted by guacd
+const maxBlobLength = 6048
+
+// Time the index of a closed outbound stream stays reserved while acknowledgements for it are still
+// missing. Servers don't acknowledge some streams at all (ex: clipboard), unless they refuse them
+const streamIndexQuarantine = 5 * time.Second
+
+type onBlobFunc func(s *stream, data string) error
 type onEndFunc func(s *stream)
+type onDiscardFunc func(err error)
 
+// stream accumulates all data received, until it ends. If onBlob is set, the
+// data is passed to it instead, as soon as it is received. If the stream is discarded
+// before it ends, onDiscard is called instead of onEnd. Blobs buffered are only acknowledged
+// if ack is set, for streams where the server waits for acks before sending more (ex: clipboard)
 type stream struct {
-	buffer *bytes.Buffer
-	onEnd  onEndFunc
+	buffer    *bytes.Buffer
+	ack       bool
+	onBlob    onBlobFunc
+	onEnd     onEndFunc
+	onDiscard onDiscardFunc
 }
 
 func (s *stream) image() (image.Image, error) {
@@ -19,38 +43,235 @@ func (s *stream) image() (image.Image, error) {
 	return img, err
 }
 
-type streams map[int]*stream
+// data returns the decoded contents of the stream
+func (s *stream) data() ([]byte, error) {
+	return ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, s.buffer))
+}
+
+// ErrStreamClosed is returned when using a stream that was discarded, because the connection with the
+// server was reestablished: when waiting on outbound streams, or reading files and pipes being received
+var ErrStreamClosed = errors.New("stream closed")
+
+// ack is the acknowledgement sent by the server for an outbound stream
+type ack struct {
+	message string
+	status  StatusCode
+}
+
+// outputStream is a stream opened by the Client to send data to the server
+type outputStream struct {
+	index  int
+	acks   chan ack
+	closed chan struct{}
+	mutex  sync.Mutex
+	err    error
+
+	// Guarded by the streamManager mutex
+	pending  int
+	closedAt time.Time
+}
 
-func newStreams() streams {
-	return make(map[int]*stream)
+// Err returns the error reported by the server for this stream, if any
+func (s *outputStream) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
 }
 
-func (ss streams) get(id int) *stream {
-	if s, ok := ss[id]; ok {
+func (s *outputStream) fail(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// wait for the next acknowledgement of the stream, returning its status as an error if it is not successful
+func (s *outputStream) wait(done <-chan struct{}) error {
+	select {
+	case <-s.acks:
+		return s.Err()
+	case <-s.closed:
+		return s.Err()
+	case <-done:
+		return ErrNotConnected
+	}
+}
+
+// streamManager keeps track of all streams with the server: inbound streams, opened by the server to send
+// data to the Client (images, clipboard, files...), and outbound streams, opened by the Client. Inbound
+// streams are only used by the goroutine processing the instructions, while outbound streams can be
+// opened from any goroutine. Indexes of outbound streams are reused after the streams are closed and
+// all their acknowledgements are received, so a late ack is never taken as the ack of a new stream
+type streamManager struct {
+	send    func(ins ...*protocol.Instruction) error
+	logger  Logger
+	inbound map[int]*stream
+
+	mutex    sync.Mutex
+	outbound map[int]*outputStream
+	next     int
+	free     []int
+}
+
+func newStreamManager(send func(ins ...*protocol.Instruction) error, logger Logger) *streamManager {
+	return &streamManager{
+		send:     send,
+		logger:   logger,
+		inbound:  make(map[int]*stream),
+		outbound: make(map[int]*outputStream),
+	}
+}
+
+// get returns the inbound stream idx, creating it if it does not exist
+func (m *streamManager) get(idx int) *stream {
+	if s, ok := m.inbound[idx]; ok {
 		return s
 	}
 	s := &stream{
 		buffer: &bytes.Buffer{},
 	}
-	ss[id] = s
+	m.inbound[idx] = s
 	return s
 }
 
-func (ss streams) append(id int, data string) error {
-	s := ss.get(id)
-	_, err := s.buffer.WriteString(data)
-	return err
+// append a blob to the inbound stream idx. If the stream has an onBlob handler, it is responsible for
+// acknowledging the blob. Otherwise, the blob is buffered and, if the stream is flow controlled,
+// acknowledged immediately
+func (m *streamManager) append(idx int, data string) error {
+	s := m.get(idx)
+	if s.onBlob != nil {
+		return s.onBlob(s, data)
+	}
+	if _, err := s.buffer.WriteString(data); err != nil {
+		return err
+	}
+	if !s.ack {
+		return nil
+	}
+	return m.sendAck(idx, "OK", StatusSuccess)
 }
 
-func (ss streams) end(id int) {
-	s := ss.get(id)
+func (m *streamManager) end(idx int) {
+	s := m.get(idx)
 	if s.onEnd != nil {
 		s.onEnd(s)
 	}
 }
 
-func (ss streams) delete(id int) {
-	ss[id].buffer = nil
-	ss[id] = nil
-	delete(ss, id)
+func (m *streamManager) delete(idx int) {
+	if s, ok := m.inbound[idx]; ok {
+		s.buffer = nil
+	}
+	delete(m.inbound, idx)
+}
+
+// sendAck acknowledges the receipt of a blob or the creation of the inbound stream idx, reporting its
+// status to the server
+func (m *streamManager) sendAck(idx int, message string, status StatusCode) error {
+	return m.send(protocol.NewInstruction("ack", strconv.Itoa(idx), message, strconv.Itoa(int(status))))
+}
+
+// open a new outbound stream, allocating its index. It must be closed when no longer used
+func (m *streamManager) open() *outputStream {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, s := range m.outbound {
+		if !s.closedAt.IsZero() && time.Since(s.closedAt) > streamIndexQuarantine {
+			m.release(s)
+		}
+	}
+	var idx int
+	if len(m.free) > 0 {
+		idx = m.free[0]
+		m.free = m.free[1:]
+	} else {
+		idx = m.next
+		m.next++
+	}
+	s := &outputStream{
+		index:  idx,
+		acks:   make(chan ack, 1),
+		closed: make(chan struct{}),
+	}
+	m.outbound[idx] = s
+	return s
+}
+
+// write sends an instruction of the outbound stream that the server may acknowledge (the instruction
+// creating it or a blob), so its index is kept reserved until the acknowledgement arrives
+func (m *streamManager) write(s *outputStream, ins *protocol.Instruction) error {
+	m.mutex.Lock()
+	s.pending++
+	m.mutex.Unlock()
+	return m.send(ins)
+}
+
+// close the outbound stream. Its index is released to be reused once all acknowledgements expected
+// for the stream are received, or after streamIndexQuarantine
+func (m *streamManager) close(s *outputStream) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.outbound[s.index] != s || !s.closedAt.IsZero() {
+		return
+	}
+	if s.pending == 0 {
+		m.release(s)
+		return
+	}
+	s.closedAt = time.Now()
+}
+
+// release the index of the outbound stream. It must be called with the mutex held
+func (m *streamManager) release(s *outputStream) {
+	delete(m.outbound, s.index)
+	m.free = append(m.free, s.index)
+}
+
+// acknowledge handles an "ack" received for an outbound stream. Error statuses are recorded as the
+// stream error, and no more data should be sent through it
+func (m *streamManager) acknowledge(idx int, message string, status StatusCode) {
+	m.mutex.Lock()
+	s, ok := m.outbound[idx]
+	closed := ok && !s.closedAt.IsZero()
+	if ok && s.pending > 0 {
+		s.pending--
+	}
+	if closed && s.pending == 0 {
+		m.release(s)
+	}
+	m.mutex.Unlock()
+	if !ok || closed {
+		m.logger.Debugf("Ignoring ack for closed stream %d: %s (%s)", idx, message, status)
+		return
+	}
+	if status.IsError() {
+		m.logger.Warnf("Stream %d failed: %s (%s)", idx, message, status)
+		s.fail(&StreamError{Index: idx, Status: status, Message: message})
+	}
+	select {
+	case s.acks <- ack{message: message, status: status}:
+	default:
+		// Nobody is waiting for this ack. Any error was already recorded
+	}
+}
+
+// reset discards all streams, as they are not valid after a new connection. Inbound and outbound
+// streams in use fail with ErrStreamClosed
+func (m *streamManager) reset() {
+	for _, s := range m.inbound {
+		if s.onDiscard != nil {
+			s.onDiscard(ErrStreamClosed)
+		}
+	}
+	m.inbound = make(map[int]*stream)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for idx, s := range m.outbound {
+		s.fail(ErrStreamClosed)
+		close(s.closed)
+		delete(m.outbound, idx)
+	}
+	m.next, m.free = 0, nil
 }
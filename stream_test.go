@@ -4,22 +4,31 @@ import (
 	"image"
 	_ "image/jpeg"
 	_ "image/png"
+	"time"
+
+	"github.com/deluan/bring/protocol"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("Streams", func() {
-	var ss streams
+	var ss *streamManager
+	var sent []*protocol.Instruction
 	BeforeEach(func() {
-		ss = newStreams()
+		sent = nil
+		send := func(ins ...*protocol.Instruction) error {
+			sent = append(sent, ins...)
+			return nil
+		}
+		ss = newStreamManager(send, &DefaultLogger{Quiet: true})
 	})
 
 	It("creates a new stream when it does not exist", func() {
 		s := ss.get(1)
 
 		Expect(s.buffer).ToNot(BeNil())
-		Expect(ss[1]).To(Equal(s))
+		Expect(ss.inbound[1]).To(Equal(s))
 	})
 
 	Context("Given an new empty stream", func() {
@@ -35,6 +44,30 @@ var _ = Describe("Streams", func() {
 			Expect(s.buffer.String()).To(Equal("test data"))
 		})
 
+		It("does not acknowledge the blobs received, if the stream is not flow controlled", func() {
+			Expect(ss.append(2, "test data")).To(Succeed())
+			Expect(sent).To(BeEmpty())
+		})
+
+		It("acknowledges the blobs received, if the stream is flow controlled", func() {
+			s.ack = true
+			Expect(ss.append(2, "test data")).To(Succeed())
+
+			Expect(sent).To(Equal([]*protocol.Instruction{protocol.NewInstruction("ack", "2", "OK", "0")}))
+		})
+
+		It("leaves the acknowledgement to the onBlob handler, if there is one", func() {
+			var received string
+			s.onBlob = func(_ *stream, data string) error {
+				received = data
+				return nil
+			}
+			Expect(ss.append(2, "test data")).To(Succeed())
+
+			Expect(received).To(Equal("test data"))
+			Expect(sent).To(BeEmpty())
+		})
+
 		It("decodes bas64 images", func() {
 			err := ss.append(2, "iVBORw0KGgoAAAANSUhEUgAAAAEAAAAPAgMAAABYcU1qAAAACVBMVEX8/Pzc3Nzr6+uSJe5dAAAAEUlEQVQImWNgAAIHhgYGrAAAEd4AwbcvDeEAAAAASUVORK5CYII=")
 			Expect(err).To(BeNil())
@@ -55,12 +88,75 @@ var _ = Describe("Streams", func() {
 		})
 
 		It("removes it from the streams map", func() {
-			previousSize := len(ss)
+			previousSize := len(ss.inbound)
 			ss.delete(2)
 
-			Expect(ss[2]).To(BeNil())
-			Expect(ss).To(HaveLen(previousSize - 1))
+			Expect(ss.inbound[2]).To(BeNil())
+			Expect(ss.inbound).To(HaveLen(previousSize - 1))
+		})
+
+	})
+
+	Context("Outbound streams", func() {
+		It("allocates sequential indexes, reusing the released ones", func() {
+			s0, s1, s2 := ss.open(), ss.open(), ss.open()
+			Expect([]int{s0.index, s1.index, s2.index}).To(Equal([]int{0, 1, 2}))
+			ss.close(s1)
+			Expect(ss.open().index).To(Equal(1))
+			Expect(ss.open().index).To(Equal(3))
+		})
+
+		It("keeps the index of a closed stream until its acknowledgements are received", func() {
+			s := ss.open()
+			Expect(ss.write(s, protocol.NewInstruction("blob", "0", "YQ=="))).To(Succeed())
+			Expect(ss.write(s, protocol.NewInstruction("blob", "0", "Yg=="))).To(Succeed())
+			ss.close(s)
+			next := ss.open()
+			Expect(next.index).To(Equal(1))
+
+			ss.acknowledge(0, "Unsupported", StatusUnsupported)
+			Expect(next.Err()).To(BeNil())
+			ss.acknowledge(0, "Unsupported", StatusUnsupported)
+			Expect(ss.open().index).To(Equal(0))
+		})
+
+		It("releases the index of a closed stream never acknowledged after a while", func() {
+			s := ss.open()
+			Expect(ss.write(s, protocol.NewInstruction("clipboard", "0", "text/plain"))).To(Succeed())
+			ss.close(s)
+			Expect(ss.open().index).To(Equal(1))
+
+			s.closedAt = s.closedAt.Add(-streamIndexQuarantine - time.Second)
+			Expect(ss.open().index).To(Equal(0))
+		})
+
+		It("delivers acknowledgements to the stream waiting for them", func() {
+			s := ss.open()
+			ss.acknowledge(s.index, "OK", StatusSuccess)
+
+			Expect(s.wait(nil)).To(Succeed())
+			Expect(s.Err()).To(BeNil())
 		})
 
+		It("records errors reported by the server", func() {
+			s := ss.open()
+			ss.acknowledge(s.index, "Read-only", StatusClientForbidden)
+
+			expected := &StreamError{Index: s.index, Status: StatusClientForbidden, Message: "Read-only"}
+			Expect(s.wait(nil)).To(Equal(expected))
+			Expect(s.Err()).To(Equal(expected))
+		})
+
+		It("ignores acknowledgements for unknown streams", func() {
+			Expect(func() { ss.acknowledge(5, "OK", StatusSuccess) }).ToNot(Panic())
+		})
+
+		It("fails all streams in use when reset", func() {
+			s := ss.open()
+			ss.reset()
+
+			Expect(s.wait(nil)).To(Equal(ErrStreamClosed))
+			Expect(ss.open().index).To(Equal(0))
+		})
 	})
 })
@@ -0,0 +1,127 @@
+package bring
+
+import (
+	"encoding/base64"
+	"image"
+	"io"
+)
+
+// VideoDecoder decodes the video streams sent by the server. The mimetypes it supports are reported
+// to the server during the handshake, unless others are set with WithVideoMimetypes
+type VideoDecoder interface {
+	// Mimetypes returns the video mimetypes supported by the decoder
+	Mimetypes() []string
+	// NewStream is called when the server starts sending a video, returning the decoder for that stream.
+	// If it returns an error, the stream is refused
+	NewStream(mimetype string) (VideoStreamDecoder, error)
+}
+
+// VideoStreamDecoder decodes a single video stream
+type VideoStreamDecoder interface {
+	// Decode receives the next chunk of encoded data, returning all frames completed by it. Frames are
+	// drawn on the layer targeted by the stream, in the order they are returned
+	Decode(data []byte) ([]image.Image, error)
+	// Close is called when the stream ends
+	Close() error
+}
+
+// WithVideoDecoder sets the VideoDecoder used to decode the video streams sent by the server. By default,
+// no video mimetype is reported to the server, and any video received is discarded
+func WithVideoDecoder(decoder VideoDecoder) Option {
+	return func(o *options) {
+		o.videoDecoder = decoder
+	}
+}
+
+// nopVideoDecoder is the default VideoDecoder. It does not support any mimetype, and discards all video received
+type nopVideoDecoder struct{}
+
+func (nopVideoDecoder) Mimetypes() []string { return nil }
+
+func (nopVideoDecoder) NewStream(string) (VideoStreamDecoder, error) {
+	return nopVideoDecoder{}, nil
+}
+
+func (nopVideoDecoder) Decode([]byte) ([]image.Image, error) { return nil, nil }
+
+func (nopVideoDecoder) Close() error { return nil }
+
+// RawVideoDecoder is a VideoDecoder that does not decode anything. It writes the encoded data of each
+// stream to a writer, so the video sent by the server can be recorded and inspected with external tools
+type RawVideoDecoder struct {
+	mimetypes []string
+	create    func(mimetype string) (io.WriteCloser, error)
+}
+
+// NewRawVideoDecoder creates a RawVideoDecoder that reports the mimetypes provided as supported, and
+// calls create to obtain the writer for each stream. The writer is closed when the stream ends
+func NewRawVideoDecoder(create func(mimetype string) (io.WriteCloser, error), mimetypes ...string) *RawVideoDecoder {
+	return &RawVideoDecoder{mimetypes: mimetypes, create: create}
+}
+
+func (d *RawVideoDecoder) Mimetypes() []string {
+	return d.mimetypes
+}
+
+func (d *RawVideoDecoder) NewStream(mimetype string) (VideoStreamDecoder, error) {
+	w, err := d.create(mimetype)
+	if err != nil {
+		return nil, err
+	}
+	return &rawVideoStream{w: w}, nil
+}
+
+type rawVideoStream struct {
+	w io.WriteCloser
+}
+
+func (s *rawVideoStream) Decode(data []byte) ([]image.Image, error) {
+	_, err := s.w.Write(data)
+	return nil, err
+}
+
+func (s *rawVideoStream) Close() error {
+	return s.w.Close()
+}
+
+// videoStream feeds the blobs of a video stream to its decoder, drawing the frames decoded on the target layer
+type videoStream struct {
+	client   *Client
+	idx      int
+	layerIdx int
+	decoder  VideoStreamDecoder
+	failed   bool
+}
+
+// receive is used as the onBlob handler of the stream
+func (v *videoStream) receive(_ *stream, data string) error {
+	if v.failed {
+		return nil
+	}
+	encoded, err := base64.StdEncoding.DecodeString(data)
+	if err == nil {
+		var frames []image.Image
+		frames, err = v.decoder.Decode(encoded)
+		for _, frame := range frames {
+			v.client.display.drawFrame(v.layerIdx, frame)
+		}
+	}
+	if err != nil {
+		v.failed = true
+		v.client.logger.Errorf("Failed decoding video stream %d: %s", v.idx, err)
+		return v.client.streams.sendAck(v.idx, "Invalid video", StatusClientBadType)
+	}
+	return v.client.streams.sendAck(v.idx, "OK", StatusSuccess)
+}
+
+// end is used as the onEnd handler of the stream
+func (v *videoStream) end(_ *stream) {
+	if err := v.decoder.Close(); err != nil {
+		v.client.logger.Warnf("Error closing video stream %d: %s", v.idx, err)
+	}
+}
+
+// discard is used as the onDiscard handler of the stream, releasing the decoder
+func (v *videoStream) discard(_ error) {
+	v.end(nil)
+}
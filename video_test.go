@@ -0,0 +1,120 @@
+package bring
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+
+	"github.com/deluan/bring/protocol"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeVideoDecoder "decodes" each byte received as a 2x2 frame filled with that gray level
+type fakeVideoDecoder struct {
+	closed bool
+}
+
+func (d *fakeVideoDecoder) Mimetypes() []string { return []string{"video/fake"} }
+
+func (d *fakeVideoDecoder) NewStream(mimetype string) (VideoStreamDecoder, error) {
+	if mimetype != "video/fake" {
+		return nil, errors.New("unsupported")
+	}
+	return d, nil
+}
+
+func (d *fakeVideoDecoder) Decode(data []byte) ([]image.Image, error) {
+	var frames []image.Image
+	for _, b := range data {
+		frame := image.NewRGBA(image.Rect(0, 0, 2, 2))
+		for i := range frame.Pix {
+			frame.Pix[i] = b
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+func (d *fakeVideoDecoder) Close() error {
+	d.closed = true
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+	closed bool
+}
+
+func (w *nopWriteCloser) Close() error {
+	w.closed = true
+	return nil
+}
+
+var _ = Describe("Video", func() {
+	var c *Client
+	var t *mockTunnel
+	var decoder *fakeVideoDecoder
+
+	BeforeEach(func() {
+		t = &mockTunnel{}
+		decoder = &fakeVideoDecoder{}
+		c = newTestClient(t)
+		c.videoDecoder = decoder
+	})
+
+	It("draws the decoded frames on the target layer", func() {
+		Expect(handlers["size"](c, []string{"0", "2", "2"})).To(Succeed())
+		Expect(handlers["video"](c, []string{"1", "0", "video/fake"})).To(Succeed())
+		Expect(handlers["blob"](c, []string{"1", base64.StdEncoding.EncodeToString([]byte{0x10, 0x80})})).To(Succeed())
+		Expect(handlers["end"](c, []string{"1"})).To(Succeed())
+		c.display.flush()
+
+		img, _ := c.Screen()
+		Expect(img.Bounds()).To(Equal(image.Rect(0, 0, 2, 2)))
+		Expect(img.At(1, 1)).To(Equal(color.RGBA{0x80, 0x80, 0x80, 0x80}))
+		Expect(decoder.closed).To(BeTrue())
+		Expect(t.sent).To(Equal([]*protocol.Instruction{protocol.NewInstruction("ack", "1", "OK", "0")}))
+	})
+
+	It("refuses streams not supported by the decoder", func() {
+		Expect(handlers["video"](c, []string{"1", "0", "video/other"})).To(Succeed())
+		Expect(t.sent).To(Equal([]*protocol.Instruction{
+			protocol.NewInstruction("ack", "1", "Unsupported video format", "783"),
+		}))
+	})
+
+	It("reports the decoder mimetypes during the handshake", func() {
+		o := testOptions(WithVideoDecoder(decoder))
+		Expect(o.handshake.videoMimetypes).To(Equal([]string{"video/fake"}))
+
+		o = testOptions(WithVideoDecoder(decoder), WithVideoMimetypes("video/other"))
+		Expect(o.handshake.videoMimetypes).To(Equal([]string{"video/other"}))
+
+		Expect(testOptions().handshake.videoMimetypes).To(BeEmpty())
+	})
+
+	Describe("RawVideoDecoder", func() {
+		It("writes the encoded data of each stream", func() {
+			buf := &bytes.Buffer{}
+			w := &nopWriteCloser{Writer: buf}
+			var mimetype string
+			c.videoDecoder = NewRawVideoDecoder(func(m string) (io.WriteCloser, error) {
+				mimetype = m
+				return w, nil
+			}, "video/mp4")
+
+			Expect(handlers["video"](c, []string{"1", "0", "video/mp4"})).To(Succeed())
+			Expect(handlers["blob"](c, []string{"1", "YnJpbmcg"})).To(Succeed())
+			Expect(handlers["blob"](c, []string{"1", "aXQgb24="})).To(Succeed())
+			Expect(handlers["end"](c, []string{"1"})).To(Succeed())
+
+			Expect(mimetype).To(Equal("video/mp4"))
+			Expect(buf.String()).To(Equal("bring it on"))
+			Expect(w.closed).To(BeTrue())
+		})
+	})
+})